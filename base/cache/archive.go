@@ -0,0 +1,246 @@
+package cache
+
+import (
+	"archive/tar"
+	"cess-cacher/config"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// PAX records carrying the index entry and the digest of each slice in the archive
+	PAX_FILE_INFO = "CESS.fileinfo"
+	PAX_DIGEST    = "CESS.sha256"
+)
+
+// ExportFilter selects the slices to be exported,
+// empty Hashes means all files, and Top <= 0 means no limit.
+type ExportFilter struct {
+	Hashes   []string
+	MinCount int
+	Top      int
+}
+
+func (f ExportFilter) match(hash string, info FileInfo) bool {
+	if info.UsedCount < f.MinCount {
+		return false
+	}
+	if len(f.Hashes) == 0 {
+		return true
+	}
+	fid := strings.Split(hash, "-")[0]
+	for _, h := range f.Hashes {
+		if h == fid {
+			return true
+		}
+	}
+	return false
+}
+
+func readMetadata() (map[string]FileInfo, error) {
+	var list map[string]FileInfo
+	bytes, err := os.ReadFile(FilePath)
+	if err != nil {
+		return nil, errors.Wrap(err, "read metadata file error")
+	}
+	if err = json.Unmarshal(bytes, &list); err != nil {
+		return nil, errors.Wrap(err, "unmarshal metadata file error")
+	}
+	if list == nil {
+		list = make(map[string]FileInfo)
+	}
+	return list, nil
+}
+
+func writeMetadata(list map[string]FileInfo) error {
+	bytes, err := json.Marshal(list)
+	if err != nil {
+		return errors.Wrap(err, "save hash list error")
+	}
+	err = os.WriteFile(FilePath, bytes, os.ModePerm)
+	return errors.Wrap(err, "save hash list error")
+}
+
+// ExportCache writes the selected slices and their index entries into a tar stream,
+// encrypted slices are exported decrypted so that the archive can be imported with other keys.
+func ExportCache(conf config.Config, w io.Writer, filter ExportFilter) (int, error) {
+	setCacheDir(conf)
+	setLayout(conf)
+	if err := InitKeyRing(conf); err != nil {
+		return 0, errors.Wrap(err, "export cache error")
+	}
+	list, err := readMetadata()
+	if err != nil {
+		return 0, errors.Wrap(err, "export cache error")
+	}
+	var hashs []string
+	for k, v := range list {
+		if filter.match(k, v) {
+			hashs = append(hashs, k)
+		}
+	}
+	//the hottest slices come first
+	sortByHotness(hashs, list)
+	if filter.Top > 0 && len(hashs) > filter.Top {
+		hashs = hashs[:filter.Top]
+	}
+	tw := tar.NewWriter(w)
+	var count int
+	for _, hash := range hashs {
+		if err = exportSlice(tw, hash, list[hash]); err != nil {
+			return count, errors.Wrap(err, "export cache error")
+		}
+		count++
+	}
+	return count, errors.Wrap(tw.Close(), "export cache error")
+}
+
+func exportSlice(tw *tar.Writer, hash string, info FileInfo) error {
+	paths := strings.Split(hash, "-")
+	fpath, err := LocateSlice(paths[0], paths[1])
+	if err != nil {
+		return err
+	}
+	//the first pass computes the digest and size of the exported content
+	r, err := OpenSlice(fpath, false)
+	if err != nil {
+		return err
+	}
+	h := sha256.New()
+	size, err := io.Copy(h, r)
+	r.Close()
+	if err != nil {
+		return err
+	}
+	info.Digest = ""
+	data, err := json.Marshal(info)
+	if err != nil {
+		return err
+	}
+	name := path.Join(paths[0], paths[1]+strings.TrimSuffix(strings.TrimPrefix(fpath, SlicePath(paths[0], paths[1])), ENCRYPTED_SUFFIX))
+	err = tw.WriteHeader(&tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     name,
+		Size:     size,
+		Mode:     0666,
+		ModTime:  info.LoadTime,
+		Format:   tar.FormatPAX,
+		PAXRecords: map[string]string{
+			PAX_FILE_INFO: string(data),
+			PAX_DIGEST:    hex.EncodeToString(h.Sum(nil)),
+		},
+	})
+	if err != nil {
+		return err
+	}
+	if r, err = OpenSlice(fpath, false); err != nil {
+		return err
+	}
+	defer r.Close()
+	_, err = io.Copy(tw, r)
+	return err
+}
+
+// ImportCache reads slices from a tar stream written by ExportCache into the configured cache,
+// every slice is verified against its digest before it is put in place.
+// It refuses to run while a cacher is using the directory, whose index would overwrite the imported entries.
+func ImportCache(conf config.Config, r io.Reader) (int, error) {
+	setCacheDir(conf)
+	setLayout(conf)
+	Encrypt = conf.Encrypt
+	if err := InitKeyRing(conf); err != nil {
+		return 0, errors.Wrap(err, "import cache error")
+	}
+	if err := os.MkdirAll(FilesDir, 0777); err != nil {
+		return 0, errors.Wrap(err, "import cache error")
+	}
+	lock, err := lockCacheDir()
+	if err != nil {
+		return 0, errors.Wrap(err, "import cache error")
+	}
+	if lock != nil {
+		defer lock.Close()
+	}
+	list, err := readMetadata()
+	if err != nil && !os.IsNotExist(errors.Cause(err)) {
+		return 0, errors.Wrap(err, "import cache error")
+	}
+	if list == nil {
+		list = make(map[string]FileInfo)
+	}
+	tr := tar.NewReader(r)
+	var count int
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return count, errors.Wrap(err, "import cache error")
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+		hash, info, err := importSlice(tr, hdr)
+		if err != nil {
+			return count, errors.Wrap(err, "import cache error")
+		}
+		list[hash] = info
+		count++
+	}
+	return count, errors.Wrap(writeMetadata(list), "import cache error")
+}
+
+func importSlice(tr *tar.Reader, hdr *tar.Header) (string, FileInfo, error) {
+	var info FileInfo
+	fid, name := path.Split(path.Clean(hdr.Name))
+	fid = strings.Trim(fid, "/")
+	sid := TrimSliceSuffix(name)
+	if len(fid) != FILE_HASH_LEN || strings.Contains(fid, "/") || sid == "" {
+		return "", info, errors.New("bad slice name " + hdr.Name)
+	}
+	if err := json.Unmarshal([]byte(hdr.PAXRecords[PAX_FILE_INFO]), &info); err != nil {
+		return "", info, errors.Wrap(err, "bad index entry of "+hdr.Name)
+	}
+	if err := os.MkdirAll(FileDir(fid), 0777); err != nil {
+		return "", info, err
+	}
+	if err := RemoveSlice(fid, sid); err != nil {
+		return "", info, err
+	}
+	fpath := SlicePath(fid, sid) + strings.TrimPrefix(name, sid)
+	tmp := fpath + TEMP_SUFFIX
+	f, err := os.Create(tmp)
+	if err != nil {
+		return "", info, err
+	}
+	defer os.Remove(tmp)
+	h := sha256.New()
+	_, err = io.Copy(io.MultiWriter(f, h), tr)
+	f.Close()
+	if err != nil {
+		return "", info, err
+	}
+	if hex.EncodeToString(h.Sum(nil)) != hdr.PAXRecords[PAX_DIGEST] {
+		return "", info, errors.New("digest mismatch of " + hdr.Name)
+	}
+	if err = os.Rename(tmp, fpath); err != nil {
+		return "", info, err
+	}
+	if Encrypt {
+		if _, _, err = EncryptSlice(fpath, info.Size); err != nil {
+			return "", info, err
+		}
+	}
+	if _, diskSize, err := SliceSize(fid, sid); err == nil {
+		info.DiskSize = diskSize
+	}
+	return fid + "-" + sid, info, nil
+}
@@ -2,6 +2,8 @@ package cache
 
 import (
 	"cess-cacher/base/chain"
+	"cess-cacher/base/cluster"
+	"cess-cacher/base/trans"
 	"cess-cacher/config"
 	"cess-cacher/logger"
 	"cess-cacher/utils"
@@ -14,8 +16,14 @@ import (
 
 var FilesDir = "./cache/files"
 var FilePath = "./cache/metadata.json"
+var LockPath = "./cache/cacher.lock"
 var handler CacheHandle
 
+// dirLock is held by the running cacher, the offline commands refuse to change the cache directory meanwhile
+var dirLock *os.File
+
+var ERR_CacheInUse = errors.New("cache directory is used by a running cacher")
+
 type ICache interface {
 	GetCacheStats() Stat
 	FindHashs(hash ...string) []string
@@ -23,8 +31,15 @@ type ICache interface {
 	TotalSize() uint64
 	QueryFile(hash string) (FileInfo, bool)
 	HitOrLoad(hash string) (bool, error)
+	Peek(hash string) bool
 	GetFileDir() string
 	LoadFailedFile(shash string) (int, bool)
+	RecordPaid(hash string, amount uint64)
+	RecordRefused(hash string, amount uint64)
+	ExpectedEarnings(hash string) uint64
+	GetEarningsStat() EarningsStat
+	GetFillQueue() FillQueueStat
+	GetWindowStats() []WindowStat
 }
 
 type CacheHandle struct {
@@ -40,14 +55,26 @@ func (h CacheHandle) GetFileDir() string {
 	return FilesDir
 }
 
+// Peek reports whether the slice is cached and records the access, a miss starts no fill
+func (h CacheHandle) Peek(hash string) bool {
+	res := h.FindHashs(hash)
+	if len(res) == 1 && res[0] == hash {
+		h.Access(hash)
+		return true
+	}
+	return false
+}
+
 func (h CacheHandle) HitOrLoad(hash string) (bool, error) {
 	res := h.FindHashs(hash)
 	if len(res) == 1 && res[0] == hash {
 		h.Hit(1)
+		h.Access(hash)
 		return true, nil
 	}
 	//Reduce the impact of invalid requests on hit rate
 	if handler.cacheQueue.Query(hash) {
+		handler.fills.Touch(hash)
 		return false, nil
 	}
 	downloading, err := CheckAndCacheFile(hash)
@@ -60,16 +87,32 @@ func (h CacheHandle) HitOrLoad(hash string) (bool, error) {
 	return !downloading, nil
 }
 
-func InitCache(conf config.Config) error {
-	if conf.CacheDir != "" {
-		FilesDir = path.Join(conf.CacheDir, "files")
-		FilePath = path.Join(conf.CacheDir, "metadata.json")
+// Shutdown saves the state of cache and cancels the running fills before cacher exits
+func Shutdown() {
+	if handler.Cache != nil {
+		handler.Cache.Shutdown()
 	}
+}
+
+func InitCache(conf config.Config) error {
+	setCacheDir(conf)
 	if _, err := os.Stat(FilesDir); err != nil {
 		if err = os.MkdirAll(FilesDir, 0777); err != nil {
 			return errors.Wrap(err, "init cache error")
 		}
 	}
+	if _, err := os.Stat(BlobsDir); err != nil {
+		if err = os.MkdirAll(BlobsDir, 0777); err != nil {
+			return errors.Wrap(err, "init cache error")
+		}
+	}
+	if dirLock == nil {
+		lock, err := lockCacheDir()
+		if err != nil {
+			return errors.Wrap(err, "init cache error")
+		}
+		dirLock = lock
+	}
 	if _, err := os.Stat(FilePath); err != nil {
 		f, err := os.Create(FilePath)
 		if err != nil {
@@ -78,7 +121,22 @@ func InitCache(conf config.Config) error {
 		f.WriteString("{}")
 		f.Close()
 	}
+	if err := initLayout(conf); err != nil {
+		return errors.Wrap(err, "init cache error")
+	}
+	Encrypt = conf.Encrypt
+	if err := InitKeyRing(conf); err != nil {
+		return errors.Wrap(err, "init cache error")
+	}
 	initMinerInfo()
+	initWindowStats()
+	initTTL(conf)
+	if err := cluster.Init(conf); err != nil {
+		return errors.Wrap(err, "init cache error")
+	}
+	if err := trans.InitSources(conf); err != nil {
+		return errors.Wrap(err, "init cache error")
+	}
 
 	stat, err := GetDiskStats()
 	if err != nil {
@@ -98,9 +156,21 @@ func InitCache(conf config.Config) error {
 		Cache:      NewCache(int(qlen)),
 		CacheStats: cstat,
 	}
+	if err := handler.Cache.RecoverFillQueue(); err != nil {
+		logger.Uld.Sugar().Errorf("recover fill queue error:%v.\n", err)
+	}
+	if count := handler.Cache.CleanOrphanBlobs(); count > 0 {
+		logger.Uld.Sugar().Infof("%d orphan blobs are cleaned.", count)
+	}
 	go handler.Cache.FlashMetadataFile()
 	go handler.Cache.CacheFileServer()
-	return errors.Wrap(initStrategy(conf, handler.Cache), "init cache error")
+	go InvalidationServer(handler.Cache)
+	go WatchServer(handler.Cache)
+	if err := initStrategy(conf, handler.Cache); err != nil {
+		return errors.Wrap(err, "init cache error")
+	}
+	initWarmUp(conf, handler.Cache)
+	return nil
 }
 
 func initMinerInfo() {
@@ -113,6 +183,35 @@ func initMinerInfo() {
 	}
 }
 
+func setCacheDir(conf config.Config) {
+	if conf.CacheDir != "" {
+		FilesDir = path.Join(conf.CacheDir, "files")
+		FilePath = path.Join(conf.CacheDir, "metadata.json")
+		BlobsDir = path.Join(conf.CacheDir, "blobs")
+		QueuePath = path.Join(conf.CacheDir, "queue.json")
+		WarmUpPath = path.Join(conf.CacheDir, "warmup.json")
+		StatsPath = path.Join(conf.CacheDir, "stats.json")
+		LockPath = path.Join(conf.CacheDir, "cacher.lock")
+		RevenuePath = path.Join(conf.CacheDir, "revenue.json")
+	}
+}
+
+func initLayout(conf config.Config) error {
+	setLayout(conf)
+	count, err := MigrateLayout()
+	if count > 0 {
+		logger.Uld.Sugar().Infof("%d cached file directories are migrated to the new layout.", count)
+	}
+	return err
+}
+
+func initTTL(conf config.Config) {
+	DefaultTTL = conf.DefaultTTL
+	for fhash, ttl := range conf.FileTTL {
+		SetFileTTL(fhash, ttl)
+	}
+}
+
 func initStrategy(conf config.Config, c *Cache) error {
 	if utils.IsRateValue(conf.FreqWeight) {
 		FreqWeight = conf.FreqWeight
@@ -123,6 +222,10 @@ func initStrategy(conf config.Config, c *Cache) error {
 	if utils.IsRateValue(conf.MaxCacheRate) {
 		MaxCacheRate = conf.MaxCacheRate
 	}
+	EconomicMode = conf.EconomicMode
+	FetchCost = conf.FetchCost
+	Compress = conf.Compress
+	Dedup = conf.Dedup
 	go CleanCacheServer(c)
 	go StrategyServer(c)
 	return errors.Wrap(Reorganizate(c), "init strategy error")
@@ -130,44 +233,50 @@ func initStrategy(conf config.Config, c *Cache) error {
 
 func CheckAndCacheFile(hash string) (bool, error) {
 	paths := strings.Split(hash, "-")
-	file := path.Join(FilesDir, paths[0], paths[1])
-	if f, err := os.Stat(file); err == nil {
+	if fsize, diskSize, err := SliceSize(paths[0], paths[1]); err == nil {
 		fmeta, err := chain.GetChainCli().GetFileMetaInfo(paths[0])
 		if err != nil {
 			logger.Uld.Sugar().Errorf("check file %s error:%v", hash, err)
-			if err.Error() != chain.ERR_Empty {
+			if !chain.IsEmpty(err) {
 				handler.Error(1)
 			}
 			return false, errors.Wrap(err, "check file error")
 		}
-		var size int64
+		var size uint64
 		for _, block := range fmeta.BlockInfo {
 			if string(block.BlockId[:]) == paths[1] {
-				size = int64(block.BlockSize)
+				size = uint64(block.BlockSize)
 				break
 			}
 		}
-		if size == f.Size() {
-			handler.LoadInCache(hash, uint64(f.Size()))
+		if size == fsize {
+			handler.LoadInCache(hash, fsize, diskSize)
 			return false, nil
 		}
 	}
+	if EconomicMode {
+		size, err := GetSliceSize(paths[0], paths[1])
+		if err != nil {
+			return false, errors.Wrap(err, "check file error")
+		}
+		if !handler.Admit(hash, size) {
+			return false, errors.Wrap(ERR_NotProfitable, "check file error")
+		}
+	}
+	handler.fills.Add(hash)
 	handler.cacheQueue.Insert(hash)
 	return true, nil
 }
 
 func CheckBadFileAndDel(fid, sid string) bool {
-	file := path.Join(FilesDir, fid, sid)
-	var size int64
-	if f, err := os.Stat(file); err != nil {
+	size, _, err := SliceSize(fid, sid)
+	if err != nil {
 		return true
-	} else {
-		size = f.Size()
 	}
 	fmeta, err := chain.GetChainCli().GetFileMetaInfo(fid)
 	if err != nil {
-		if err.Error() == chain.ERR_Empty {
-			os.Remove(file)
+		if chain.IsEmpty(err) {
+			RemoveSlice(fid, sid)
 		}
 		return true
 	}
@@ -175,8 +284,8 @@ func CheckBadFileAndDel(fid, sid string) bool {
 		if string(block.BlockId[:]) != sid {
 			continue
 		}
-		if int64(block.BlockSize) != size {
-			os.Remove(file)
+		if uint64(block.BlockSize) != size {
+			RemoveSlice(fid, sid)
 			return true
 		}
 	}
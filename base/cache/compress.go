@@ -0,0 +1,170 @@
+package cache
+
+import (
+	"compress/gzip"
+	"encoding/binary"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// suffix of slices compressed at rest
+	COMPRESSED_SUFFIX = ".gz"
+	// suffix of slices being compressed or encrypted
+	TEMP_SUFFIX = ".tmp"
+	// slices that can not be compressed below this ratio are stored verbatim
+	MIN_COMPRESS_RATIO = 0.9
+)
+
+var Compress = false
+
+// all forms a slice can be stored in
+var sliceSuffixes = []string{
+	"",
+	COMPRESSED_SUFFIX,
+	ENCRYPTED_SUFFIX,
+	COMPRESSED_SUFFIX + ENCRYPTED_SUFFIX,
+}
+
+// LocateSlice returns the path of slice on disk, which may be compressed or encrypted
+func LocateSlice(fid, sid string) (string, error) {
+	fpath := SlicePath(fid, sid)
+	for _, suffix := range sliceSuffixes {
+		if _, err := os.Stat(fpath + suffix); err == nil {
+			return fpath + suffix, nil
+		}
+	}
+	return fpath, errors.Wrap(os.ErrNotExist, "locate slice error")
+}
+
+func IsCompressed(fpath string) bool {
+	return strings.HasSuffix(strings.TrimSuffix(fpath, ENCRYPTED_SUFFIX), COMPRESSED_SUFFIX)
+}
+
+// TrimSliceSuffix returns the slice id of a file name in the cache
+func TrimSliceSuffix(name string) string {
+	return strings.TrimSuffix(strings.TrimSuffix(name, ENCRYPTED_SUFFIX), COMPRESSED_SUFFIX)
+}
+
+// SliceSize returns the original size and the size on disk of slice,
+// the original size is read from the encryption header or the gzip trailer.
+func SliceSize(fid, sid string) (uint64, uint64, error) {
+	fpath, err := LocateSlice(fid, sid)
+	if err != nil {
+		return 0, 0, errors.Wrap(err, "get slice size error")
+	}
+	f, err := os.Open(fpath)
+	if err != nil {
+		return 0, 0, errors.Wrap(err, "get slice size error")
+	}
+	defer f.Close()
+	fs, err := f.Stat()
+	if err != nil {
+		return 0, 0, errors.Wrap(err, "get slice size error")
+	}
+	if IsEncrypted(fpath) {
+		size, err := encryptedOrigSize(fpath)
+		if err != nil {
+			return 0, 0, errors.Wrap(err, "get slice size error")
+		}
+		return size, uint64(fs.Size()), nil
+	}
+	if !IsCompressed(fpath) {
+		return uint64(fs.Size()), uint64(fs.Size()), nil
+	}
+	trailer := make([]byte, 4)
+	if _, err = f.ReadAt(trailer, fs.Size()-4); err != nil {
+		return 0, 0, errors.Wrap(err, "get slice size error")
+	}
+	return uint64(binary.LittleEndian.Uint32(trailer)), uint64(fs.Size()), nil
+}
+
+func RemoveSlice(fid, sid string) error {
+	fpath := SlicePath(fid, sid)
+	for _, suffix := range sliceSuffixes {
+		err := os.Remove(fpath + suffix)
+		if err != nil && !os.IsNotExist(err) {
+			return errors.Wrap(err, "remove slice error")
+		}
+	}
+	return nil
+}
+
+// CompressSlice compresses the downloaded slice in place and returns its new path and size on disk,
+// the slice is kept verbatim if compression does not save enough space.
+func CompressSlice(fpath string) (string, uint64, error) {
+	src, err := os.Open(fpath)
+	if err != nil {
+		return fpath, 0, errors.Wrap(err, "compress slice error")
+	}
+	defer src.Close()
+	fs, err := src.Stat()
+	if err != nil {
+		return fpath, 0, errors.Wrap(err, "compress slice error")
+	}
+	tmp := fpath + COMPRESSED_SUFFIX + TEMP_SUFFIX
+	dst, err := os.Create(tmp)
+	if err != nil {
+		return fpath, 0, errors.Wrap(err, "compress slice error")
+	}
+	defer os.Remove(tmp)
+	w := gzip.NewWriter(dst)
+	if _, err = io.Copy(w, src); err != nil {
+		dst.Close()
+		return fpath, 0, errors.Wrap(err, "compress slice error")
+	}
+	if err = w.Close(); err != nil {
+		dst.Close()
+		return fpath, 0, errors.Wrap(err, "compress slice error")
+	}
+	ds, err := dst.Stat()
+	dst.Close()
+	if err != nil {
+		return fpath, 0, errors.Wrap(err, "compress slice error")
+	}
+	if float64(ds.Size()) >= float64(fs.Size())*MIN_COMPRESS_RATIO {
+		return fpath, uint64(fs.Size()), nil
+	}
+	if err = os.Rename(tmp, fpath+COMPRESSED_SUFFIX); err != nil {
+		return fpath, 0, errors.Wrap(err, "compress slice error")
+	}
+	os.Remove(fpath)
+	return fpath + COMPRESSED_SUFFIX, uint64(ds.Size()), nil
+}
+
+// OpenSlice opens the slice for reading, encrypted slices are decrypted on the fly,
+// and compressed slices are decompressed if decompress is true.
+func OpenSlice(fpath string, decompress bool) (io.ReadCloser, error) {
+	f, err := os.Open(fpath)
+	if err != nil {
+		return nil, errors.Wrap(err, "open slice error")
+	}
+	var r io.Reader = f
+	if IsEncrypted(fpath) {
+		if r, err = NewDecryptReader(f); err != nil {
+			f.Close()
+			return nil, errors.Wrap(err, "open slice error")
+		}
+	}
+	if !decompress || !IsCompressed(fpath) {
+		return &sliceReader{Reader: r, file: f}, nil
+	}
+	gr, err := gzip.NewReader(r)
+	if err != nil {
+		f.Close()
+		return nil, errors.Wrap(err, "open slice error")
+	}
+	return &sliceReader{Reader: gr, file: f}, nil
+}
+
+type sliceReader struct {
+	io.Reader
+	file *os.File
+}
+
+func (s *sliceReader) Close() error {
+	return s.file.Close()
+}
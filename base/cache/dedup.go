@@ -0,0 +1,217 @@
+package cache
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"os"
+	"path"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+var (
+	Dedup    = false
+	BlobsDir = "./cache/blobs"
+)
+
+// BlobStore counts the references of content-addressed blobs,
+// slices with the same content are hard links of one blob, so the blob takes disk space only once.
+type BlobStore struct {
+	lock  sync.Mutex
+	blobs map[string]int
+	// digests of the slices released from the index, whose files are not removed yet
+	released map[string]string
+}
+
+func NewBlobStore() *BlobStore {
+	return &BlobStore{
+		blobs:    make(map[string]int),
+		released: make(map[string]string),
+	}
+}
+
+// Ref adds a reference of blob and reports whether it is the first one
+func (s *BlobStore) Ref(digest string) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.blobs[digest]++
+	return s.blobs[digest] == 1
+}
+
+// Unref removes a reference of blob and reports whether it is the last one
+func (s *BlobStore) Unref(digest string) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	count, ok := s.blobs[digest]
+	if !ok {
+		return false
+	}
+	if count <= 1 {
+		delete(s.blobs, digest)
+		return true
+	}
+	s.blobs[digest] = count - 1
+	return false
+}
+
+func (s *BlobStore) Refs(digest string) int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.blobs[digest]
+}
+
+// Release remembers the blob of the slice dropped by its last reference,
+// the blob is removed after the slice file, see Free.
+func (s *BlobStore) Release(hash, digest string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.released[hash] = digest
+}
+
+// Free removes the blob released with the slice hash, unless its content has been referenced again
+func (s *BlobStore) Free(hash string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	digest, ok := s.released[hash]
+	if !ok {
+		return
+	}
+	delete(s.released, hash)
+	if s.blobs[digest] == 0 {
+		RemoveBlob(digest)
+	}
+}
+
+func BlobPath(digest string) string {
+	return path.Join(BlobsDir, digest[:2], digest)
+}
+
+// LocateBlob returns the path of blob on disk, which may be compressed or encrypted
+func LocateBlob(digest string) (string, error) {
+	bpath := BlobPath(digest)
+	for _, suffix := range sliceSuffixes {
+		if _, err := os.Stat(bpath + suffix); err == nil {
+			return bpath + suffix, nil
+		}
+	}
+	return bpath, errors.Wrap(os.ErrNotExist, "locate blob error")
+}
+
+func RemoveBlob(digest string) {
+	bpath := BlobPath(digest)
+	for _, suffix := range sliceSuffixes {
+		os.Remove(bpath + suffix)
+	}
+}
+
+// FileDigest returns the sha256 digest of file content which names its blob,
+// it is keyed with the cache key if encryption is enabled, so blob names do not reveal the contents.
+func FileDigest(fpath string) (string, error) {
+	f, err := os.Open(fpath)
+	if err != nil {
+		return "", errors.Wrap(err, "get file digest error")
+	}
+	defer f.Close()
+	h := sha256.New()
+	if Encrypt && keyRing.current != nil {
+		h = hmac.New(sha256.New, blobKey(keyRing.current))
+	}
+	if _, err = io.Copy(h, f); err != nil {
+		return "", errors.Wrap(err, "get file digest error")
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// blobKey derives the key of blob digests from the cache key, so the cache key itself is only used by encryption
+func blobKey(key []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte("cess-cacher blob digest"))
+	return mac.Sum(nil)
+}
+
+// LinkBlob replaces the downloaded slice with a link of the existing blob of the same content,
+// it returns the new path of slice and false if there is no such blob.
+func LinkBlob(digest, fpath string) (string, bool) {
+	bpath, err := LocateBlob(digest)
+	if err != nil {
+		return fpath, false
+	}
+	target := fpath + strings.TrimPrefix(bpath, BlobPath(digest))
+	tmp := target + TEMP_SUFFIX
+	if err = os.Link(bpath, tmp); err != nil {
+		return fpath, false
+	}
+	if err = os.Rename(tmp, target); err != nil {
+		os.Remove(tmp)
+		return fpath, false
+	}
+	if target != fpath {
+		os.Remove(fpath)
+	}
+	return target, true
+}
+
+// SaveBlob links the stored slice into the blob store, slicePath is the path of slice without suffix
+func SaveBlob(digest, slicePath, fpath string) error {
+	bpath := BlobPath(digest) + strings.TrimPrefix(fpath, slicePath)
+	if err := os.MkdirAll(path.Dir(bpath), 0777); err != nil {
+		return errors.Wrap(err, "save blob error")
+	}
+	if err := os.Link(fpath, bpath); err != nil && !os.IsExist(err) {
+		return errors.Wrap(err, "save blob error")
+	}
+	return nil
+}
+
+// CleanOrphanBlobs removes the blobs not referenced by any cached slice
+func (c *Cache) CleanOrphanBlobs() int {
+	var count int
+	dirs, err := os.ReadDir(BlobsDir)
+	if err != nil {
+		return count
+	}
+	for _, d := range dirs {
+		if !d.IsDir() {
+			continue
+		}
+		files, err := os.ReadDir(path.Join(BlobsDir, d.Name()))
+		if err != nil {
+			continue
+		}
+		for _, f := range files {
+			digest := TrimSliceSuffix(strings.TrimSuffix(f.Name(), TEMP_SUFFIX))
+			if c.blobs.Refs(digest) > 0 && !strings.HasSuffix(f.Name(), TEMP_SUFFIX) {
+				continue
+			}
+			os.Remove(path.Join(BlobsDir, d.Name(), f.Name()))
+			count++
+		}
+	}
+	return count
+}
+
+// acquire takes a reference of the content of file and returns the disk space it newly takes
+func (c *Cache) acquire(info FileInfo) uint64 {
+	if info.Digest == "" || c.blobs.Ref(info.Digest) {
+		return info.OnDisk()
+	}
+	return 0
+}
+
+// release drops a reference of the content of file and returns the disk space it frees,
+// the space of a shared blob is freed by its last reference only.
+// The blob is removed with the slice file by the clean server, so the content stays on disk until then.
+func (c *Cache) release(hash string, info FileInfo) uint64 {
+	if info.Digest == "" {
+		return info.OnDisk()
+	}
+	if c.blobs.Unref(info.Digest) {
+		c.blobs.Release(hash, info.Digest)
+		return info.OnDisk()
+	}
+	return 0
+}
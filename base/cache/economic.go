@@ -0,0 +1,275 @@
+package cache
+
+import (
+	"cess-cacher/base/chain"
+	"cess-cacher/config"
+	"encoding/json"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// time span over which the expected revenue of a slice is estimated
+	REVENUE_HORIZON = time.Hour * 24
+	// revenue records not updated within this time will be cleared
+	REVENUE_EXPIRE_TIME = time.Hour * 24 * 7
+)
+
+var (
+	EconomicMode        = false
+	FetchCost    uint64 = 0
+	RevenuePath         = "./cache/revenue.json"
+
+	ERR_NotProfitable = errors.New("slice is not profitable")
+)
+
+type Revenue struct {
+	Count     int       `json:"count"`
+	Amount    uint64    `json:"amount"`
+	FirstTime time.Time `json:"firstTime"`
+	LastTime  time.Time `json:"lastTime"`
+}
+
+type Earnings struct {
+	Hash     string `json:"hash"`
+	Size     uint64 `json:"size"`
+	Earnings uint64 `json:"expectedEarnings"`
+}
+
+type EarningsStat struct {
+	Total  uint64     `json:"totalExpectedEarnings"`
+	Slices []Earnings `json:"slices"`
+}
+
+// RevenueBook records the paid downloads of slices,
+// including slices that are not (or no longer) cached.
+// The downloads refused by economic mode are recorded apart as demand, they are not revenue
+// but admission reads them, otherwise no slice would ever become profitable.
+type RevenueBook struct {
+	rw      sync.RWMutex
+	records map[string]Revenue
+	refused map[string]Revenue
+}
+
+// revenueFile is the layout of RevenuePath
+type revenueFile struct {
+	Records map[string]Revenue `json:"records"`
+	Refused map[string]Revenue `json:"refused"`
+}
+
+func NewRevenueBook() *RevenueBook {
+	return &RevenueBook{
+		records: make(map[string]Revenue),
+		refused: make(map[string]Revenue),
+	}
+}
+
+func (b *RevenueBook) Record(hash string, amount uint64) {
+	b.rw.Lock()
+	defer b.rw.Unlock()
+	b.records[hash] = addRevenue(b.records[hash], amount)
+}
+
+// RecordRefused records a download of the slice refused because it was not profitable
+func (b *RevenueBook) RecordRefused(hash string, amount uint64) {
+	b.rw.Lock()
+	defer b.rw.Unlock()
+	b.refused[hash] = addRevenue(b.refused[hash], amount)
+}
+
+func addRevenue(r Revenue, amount uint64) Revenue {
+	now := time.Now()
+	if r.Count == 0 {
+		r.FirstTime = now
+	}
+	r.Count++
+	r.Amount += amount
+	r.LastTime = now
+	return r
+}
+
+func (b *RevenueBook) Load(hash string) (Revenue, bool) {
+	b.rw.RLock()
+	defer b.rw.RUnlock()
+	r, ok := b.records[hash]
+	return r, ok
+}
+
+func (b *RevenueBook) Clear(expire time.Duration) {
+	b.rw.Lock()
+	defer b.rw.Unlock()
+	for _, records := range []map[string]Revenue{b.records, b.refused} {
+		for k, v := range records {
+			if time.Since(v.LastTime) >= expire {
+				delete(records, k)
+			}
+		}
+	}
+}
+
+// Save persists the records, so that admission keeps the revenue history across restarts
+func (b *RevenueBook) Save() error {
+	b.rw.RLock()
+	bytes, err := json.Marshal(revenueFile{Records: b.records, Refused: b.refused})
+	b.rw.RUnlock()
+	if err != nil {
+		return errors.Wrap(err, "save revenue book error")
+	}
+	err = os.WriteFile(RevenuePath, bytes, os.ModePerm)
+	return errors.Wrap(err, "save revenue book error")
+}
+
+// Recover restores the records saved before restart, the expired ones are dropped
+func (b *RevenueBook) Recover() error {
+	var saved revenueFile
+	bytes, err := os.ReadFile(RevenuePath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return errors.Wrap(err, "recover revenue book error")
+	}
+	if err = json.Unmarshal(bytes, &saved); err != nil {
+		return errors.Wrap(err, "recover revenue book error")
+	}
+	b.rw.Lock()
+	defer b.rw.Unlock()
+	for k, v := range saved.Records {
+		if time.Since(v.LastTime) < REVENUE_EXPIRE_TIME {
+			b.records[k] = v
+		}
+	}
+	for k, v := range saved.Refused {
+		if time.Since(v.LastTime) < REVENUE_EXPIRE_TIME {
+			b.refused[k] = v
+		}
+	}
+	return nil
+}
+
+func (b *RevenueBook) ClearServer() {
+	ticker := time.NewTicker(REVENUE_HORIZON)
+	defer ticker.Stop()
+	for range ticker.C {
+		b.Clear(REVENUE_EXPIRE_TIME)
+	}
+}
+
+// Expect estimates the revenue a slice of the given size will bring in the next REVENUE_HORIZON,
+// the paid download rate is observed over at least one horizon so that a single burst is not overrated.
+func (b *RevenueBook) Expect(hash string, size uint64) uint64 {
+	r, _ := b.Load(hash)
+	return expectRevenue(r, size)
+}
+
+// ExpectDemand estimates the revenue the refused downloads of a slice would bring if it were cached
+func (b *RevenueBook) ExpectDemand(hash string, size uint64) uint64 {
+	b.rw.RLock()
+	r := b.refused[hash]
+	b.rw.RUnlock()
+	return expectRevenue(r, size)
+}
+
+func expectRevenue(r Revenue, size uint64) uint64 {
+	if r.Count <= 0 {
+		return 0
+	}
+	span := time.Since(r.FirstTime)
+	if span < REVENUE_HORIZON {
+		span = REVENUE_HORIZON
+	}
+	downloads := float64(r.Count) * float64(REVENUE_HORIZON) / float64(span)
+	//the longer a slice has not been paid for, the less likely it will be
+	if idle := time.Since(r.LastTime); idle > REVENUE_HORIZON {
+		downloads *= float64(REVENUE_HORIZON) / float64(idle)
+	}
+	price := r.Amount / uint64(r.Count)
+	if price == 0 {
+		price = size * config.GetConfig().BytePrice
+	}
+	return uint64(downloads * float64(price))
+}
+
+func (c *Cache) RecordPaid(hash string, amount uint64) {
+	c.revenue.Record(hash, amount)
+}
+
+func (c *Cache) RecordRefused(hash string, amount uint64) {
+	c.revenue.RecordRefused(hash, amount)
+}
+
+func (c *Cache) ExpectedEarnings(hash string) uint64 {
+	info, ok := c.QueryFile(hash)
+	if !ok {
+		return 0
+	}
+	return c.revenue.Expect(hash, info.Size)
+}
+
+func (c *Cache) GetEarningsStat() EarningsStat {
+	var stat EarningsStat
+	c.hashMap.Range(func(key, value any) bool {
+		k, v := key.(string), value.(FileInfo)
+		e := Earnings{
+			Hash:     k,
+			Size:     v.Size,
+			Earnings: c.revenue.Expect(k, v.Size),
+		}
+		stat.Total += e.Earnings
+		stat.Slices = append(stat.Slices, e)
+		return true
+	})
+	return stat
+}
+
+// Admit decides whether a slice is worth fetching from storage miners,
+// the expected revenue, including the downloads refused so far, must cover the fetch cost when economic mode is on.
+func (c *Cache) Admit(hash string, size uint64) bool {
+	if !EconomicMode {
+		return true
+	}
+	return c.revenue.Expect(hash, size)+c.revenue.ExpectDemand(hash, size) >= size*FetchCost
+}
+
+func GetSliceSize(fid, sid string) (uint64, error) {
+	fmeta, err := chain.GetChainCli().GetFileMetaInfo(fid)
+	if err != nil {
+		return 0, errors.Wrap(err, "get slice size error")
+	}
+	for _, block := range fmeta.BlockInfo {
+		if string(block.BlockId[:]) == sid {
+			return uint64(block.BlockSize), nil
+		}
+	}
+	return 0, errors.Wrap(errors.New("slice not found"), "get slice size error")
+}
+
+// RevenueQueue puts slices with the lowest expected earnings per byte in front
+type RevenueQueue []Item
+
+func (q RevenueQueue) Len() int { return len(q) }
+func (q RevenueQueue) Less(i, j int) bool {
+	return float64(q[i].Earnings)/float64(q[i].Size+1) < float64(q[j].Earnings)/float64(q[j].Size+1)
+}
+func (q RevenueQueue) Swap(i, j int) { q[i], q[j] = q[j], q[i] }
+
+func RevenueLRU(c *Cache, cleanSize uint64) {
+	rq := RevenueQueue(GetRandomList(c, cleanSize*3))
+	for i := range rq {
+		rq[i].Earnings = c.revenue.Expect(rq[i].Hash, rq[i].Size)
+	}
+	sort.Sort(rq)
+	var size uint64
+	for _, v := range rq {
+		if size >= cleanSize {
+			break
+		}
+		size += c.Delete(v.Hash)
+		c.delQueue.Insert(v.Hash)
+		windows.Add(STAT_EVICTIONS, 1)
+	}
+}
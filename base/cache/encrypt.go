@@ -0,0 +1,410 @@
+package cache
+
+import (
+	"bufio"
+	"bytes"
+	"cess-cacher/config"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"io"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// suffix of slices encrypted at rest
+	ENCRYPTED_SUFFIX = ".enc"
+	// plaintext size of each authenticated chunk
+	ENC_CHUNK_SIZE = 64 * 1024
+	ENC_VERSION    = 1
+	ENC_HEADER_LEN = 32
+	KEY_ID_LEN     = 8
+	NONCE_PREFIX   = 7
+)
+
+var (
+	Encrypt   = false
+	ENC_MAGIC = []byte("cenc")
+	keyRing   = &KeyRing{keys: make(map[string][]byte)}
+)
+
+// KeyRing holds the key used to encrypt new slices and all keys that can still decrypt existing ones,
+// keys are identified by the first bytes of their sha256 digest, which is stored in every slice header.
+type KeyRing struct {
+	current []byte
+	id      string
+	keys    map[string][]byte
+}
+
+func KeyID(key []byte) string {
+	sum := sha256.Sum256(key)
+	return string(sum[:KEY_ID_LEN])
+}
+
+func (r *KeyRing) Add(key []byte) {
+	r.keys[KeyID(key)] = key
+}
+
+func (r *KeyRing) SetCurrent(key []byte) {
+	r.Add(key)
+	r.current = key
+	r.id = KeyID(key)
+}
+
+func (r *KeyRing) Load(id string) ([]byte, bool) {
+	key, ok := r.keys[id]
+	return key, ok
+}
+
+// DeriveSeedKey derives the encryption key from the account seed of cacher
+func DeriveSeedKey(seed string) []byte {
+	mac := hmac.New(sha256.New, []byte("cess-cacher at-rest encryption"))
+	mac.Write([]byte(seed))
+	return mac.Sum(nil)
+}
+
+// LoadKeyFile reads a 32 bytes hex encoded key, other contents are hashed into a key
+func LoadKeyFile(fpath string) ([]byte, error) {
+	data, err := os.ReadFile(fpath)
+	if err != nil {
+		return nil, errors.Wrap(err, "load key file error")
+	}
+	data = bytes.TrimSpace(data)
+	if key, err := hex.DecodeString(string(data)); err == nil && len(key) == 32 {
+		return key, nil
+	}
+	sum := sha256.Sum256(data)
+	return sum[:], nil
+}
+
+// InitKeyRing uses the key file as current key if it is configured, otherwise the key derived from account seed,
+// the seed key and old key files are kept for decrypting slices not rotated yet.
+func InitKeyRing(conf config.Config) error {
+	keyRing = &KeyRing{keys: make(map[string][]byte)}
+	if conf.AccountSeed != "" {
+		keyRing.SetCurrent(DeriveSeedKey(conf.AccountSeed))
+	}
+	for _, fpath := range conf.OldKeyFiles {
+		key, err := LoadKeyFile(fpath)
+		if err != nil {
+			return errors.Wrap(err, "init key ring error")
+		}
+		keyRing.Add(key)
+	}
+	if conf.KeyFile != "" {
+		key, err := LoadKeyFile(conf.KeyFile)
+		if err != nil {
+			return errors.Wrap(err, "init key ring error")
+		}
+		keyRing.SetCurrent(key)
+	}
+	if Encrypt && keyRing.current == nil {
+		return errors.New("init key ring error: no encryption key")
+	}
+	return nil
+}
+
+func IsEncrypted(fpath string) bool {
+	return strings.HasSuffix(fpath, ENCRYPTED_SUFFIX)
+}
+
+type encHeader struct {
+	keyID    string
+	prefix   []byte
+	origSize uint64
+	raw      []byte
+}
+
+func newEncHeader(keyID string, origSize uint64) (encHeader, error) {
+	h := encHeader{keyID: keyID, origSize: origSize, prefix: make([]byte, NONCE_PREFIX)}
+	if _, err := rand.Read(h.prefix); err != nil {
+		return h, err
+	}
+	h.raw = make([]byte, ENC_HEADER_LEN)
+	copy(h.raw, ENC_MAGIC)
+	h.raw[4] = ENC_VERSION
+	copy(h.raw[5:], keyID)
+	copy(h.raw[5+KEY_ID_LEN:], h.prefix)
+	binary.BigEndian.PutUint64(h.raw[5+KEY_ID_LEN+NONCE_PREFIX:], origSize)
+	binary.BigEndian.PutUint32(h.raw[ENC_HEADER_LEN-4:], ENC_CHUNK_SIZE)
+	return h, nil
+}
+
+func readEncHeader(r io.Reader) (encHeader, error) {
+	h := encHeader{raw: make([]byte, ENC_HEADER_LEN)}
+	if _, err := io.ReadFull(r, h.raw); err != nil {
+		return h, errors.Wrap(err, "read header error")
+	}
+	if !bytes.Equal(h.raw[:4], ENC_MAGIC) || h.raw[4] != ENC_VERSION {
+		return h, errors.New("read header error: bad magic or version")
+	}
+	if binary.BigEndian.Uint32(h.raw[ENC_HEADER_LEN-4:]) != ENC_CHUNK_SIZE {
+		return h, errors.New("read header error: unsupported chunk size")
+	}
+	h.keyID = string(h.raw[5 : 5+KEY_ID_LEN])
+	h.prefix = h.raw[5+KEY_ID_LEN : 5+KEY_ID_LEN+NONCE_PREFIX]
+	h.origSize = binary.BigEndian.Uint64(h.raw[5+KEY_ID_LEN+NONCE_PREFIX:])
+	return h, nil
+}
+
+// nonce of chunk is made of the random prefix, the chunk counter and the last chunk flag,
+// so chunks can not be reordered, dropped or truncated without failing authentication.
+func chunkNonce(prefix []byte, counter uint32, last bool) []byte {
+	nonce := make([]byte, NONCE_PREFIX+5)
+	copy(nonce, prefix)
+	binary.BigEndian.PutUint32(nonce[NONCE_PREFIX:], counter)
+	if last {
+		nonce[NONCE_PREFIX+4] = 1
+	}
+	return nonce
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// EncryptStream encrypts r into w with the current key
+func EncryptStream(w io.Writer, r io.Reader, origSize uint64) error {
+	if keyRing.current == nil {
+		return errors.New("encrypt stream error: no encryption key")
+	}
+	h, err := newEncHeader(keyRing.id, origSize)
+	if err != nil {
+		return errors.Wrap(err, "encrypt stream error")
+	}
+	aead, err := newGCM(keyRing.current)
+	if err != nil {
+		return errors.Wrap(err, "encrypt stream error")
+	}
+	if _, err = w.Write(h.raw); err != nil {
+		return errors.Wrap(err, "encrypt stream error")
+	}
+	br := bufio.NewReaderSize(r, ENC_CHUNK_SIZE)
+	buf := make([]byte, ENC_CHUNK_SIZE)
+	sealed := make([]byte, 0, ENC_CHUNK_SIZE+aead.Overhead())
+	for counter := uint32(0); ; counter++ {
+		n, err := io.ReadFull(br, buf)
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return errors.Wrap(err, "encrypt stream error")
+		}
+		_, perr := br.Peek(1)
+		last := perr == io.EOF
+		sealed = aead.Seal(sealed[:0], chunkNonce(h.prefix, counter, last), buf[:n], h.raw)
+		if _, err = w.Write(sealed); err != nil {
+			return errors.Wrap(err, "encrypt stream error")
+		}
+		if last {
+			return nil
+		}
+	}
+}
+
+type decryptReader struct {
+	r       *bufio.Reader
+	aead    cipher.AEAD
+	header  encHeader
+	counter uint32
+	buf     []byte
+	plain   []byte
+	done    bool
+}
+
+// NewDecryptReader verifies and decrypts the slice chunk by chunk while it is read
+func NewDecryptReader(r io.Reader) (io.Reader, error) {
+	br := bufio.NewReaderSize(r, ENC_CHUNK_SIZE+ENC_HEADER_LEN)
+	h, err := readEncHeader(br)
+	if err != nil {
+		return nil, errors.Wrap(err, "new decrypt reader error")
+	}
+	key, ok := keyRing.Load(h.keyID)
+	if !ok {
+		return nil, errors.New("new decrypt reader error: unknown key")
+	}
+	aead, err := newGCM(key)
+	if err != nil {
+		return nil, errors.Wrap(err, "new decrypt reader error")
+	}
+	return &decryptReader{
+		r:      br,
+		aead:   aead,
+		header: h,
+		buf:    make([]byte, ENC_CHUNK_SIZE+aead.Overhead()),
+	}, nil
+}
+
+func (d *decryptReader) Read(p []byte) (int, error) {
+	for len(d.plain) == 0 {
+		if d.done {
+			return 0, io.EOF
+		}
+		n, err := io.ReadFull(d.r, d.buf)
+		if err != nil && err != io.ErrUnexpectedEOF {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return 0, errors.Wrap(err, "decrypt slice error")
+		}
+		_, perr := d.r.Peek(1)
+		last := perr == io.EOF
+		d.plain, err = d.aead.Open(d.buf[:0], chunkNonce(d.header.prefix, d.counter, last), d.buf[:n], d.header.raw)
+		if err != nil {
+			return 0, errors.Wrap(err, "decrypt slice error")
+		}
+		d.counter++
+		d.done = last
+	}
+	n := copy(p, d.plain)
+	d.plain = d.plain[n:]
+	return n, nil
+}
+
+// EncryptSlice encrypts the slice file in place and returns the new path and size on disk
+func EncryptSlice(fpath string, origSize uint64) (string, uint64, error) {
+	src, err := os.Open(fpath)
+	if err != nil {
+		return fpath, 0, errors.Wrap(err, "encrypt slice error")
+	}
+	defer src.Close()
+	target := fpath + ENCRYPTED_SUFFIX
+	size, err := writeEncrypted(target, src, origSize)
+	if err != nil {
+		return fpath, 0, errors.Wrap(err, "encrypt slice error")
+	}
+	os.Remove(fpath)
+	return target, size, nil
+}
+
+func writeEncrypted(target string, r io.Reader, origSize uint64) (uint64, error) {
+	tmp := target + TEMP_SUFFIX
+	dst, err := os.Create(tmp)
+	if err != nil {
+		return 0, err
+	}
+	defer os.Remove(tmp)
+	if err = EncryptStream(dst, r, origSize); err != nil {
+		dst.Close()
+		return 0, err
+	}
+	ds, err := dst.Stat()
+	dst.Close()
+	if err != nil {
+		return 0, err
+	}
+	if err = os.Rename(tmp, target); err != nil {
+		return 0, err
+	}
+	return uint64(ds.Size()), nil
+}
+
+func encryptedOrigSize(fpath string) (uint64, error) {
+	f, err := os.Open(fpath)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	h, err := readEncHeader(f)
+	if err != nil {
+		return 0, err
+	}
+	return h.origSize, nil
+}
+
+// RotateCacheKeys rotates the keys of the files in the configured cache directory.
+// It refuses to run with deduplication, re-encrypting a slice would break its hard link to the blob,
+// and while a cacher is using the directory.
+func RotateCacheKeys(conf config.Config) (int, error) {
+	if conf.Dedup {
+		return 0, errors.New("rotate keys error: keys can not be rotated with Dedup enabled")
+	}
+	setCacheDir(conf)
+	setLayout(conf)
+	lock, err := lockCacheDir()
+	if err != nil {
+		return 0, errors.Wrap(err, "rotate keys error")
+	}
+	if lock != nil {
+		defer lock.Close()
+	}
+	Encrypt = conf.Encrypt
+	if err := InitKeyRing(conf); err != nil {
+		return 0, errors.Wrap(err, "rotate keys error")
+	}
+	return RotateKeys()
+}
+
+// RotateKeys re-encrypts the slices encrypted by old keys with the current key,
+// and encrypts the plaintext slices if encryption is enabled.
+func RotateKeys() (int, error) {
+	var count int
+	err := WalkFileDirs(FilesDir, func(fid, dir string) error {
+		files, err := os.ReadDir(dir)
+		if err != nil {
+			return err
+		}
+		for _, f := range files {
+			if f.IsDir() || strings.HasSuffix(f.Name(), TEMP_SUFFIX) {
+				continue
+			}
+			fpath := path.Join(dir, f.Name())
+			if !IsEncrypted(fpath) {
+				if !Encrypt {
+					continue
+				}
+				size, _, err := SliceSize(fid, TrimSliceSuffix(f.Name()))
+				if err != nil {
+					return err
+				}
+				if _, _, err = EncryptSlice(fpath, size); err != nil {
+					return err
+				}
+				count++
+				continue
+			}
+			rotated, err := rotateSlice(fpath)
+			if err != nil {
+				return err
+			}
+			if rotated {
+				count++
+			}
+		}
+		return nil
+	})
+	return count, errors.Wrap(err, "rotate keys error")
+}
+
+func rotateSlice(fpath string) (bool, error) {
+	f, err := os.Open(fpath)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+	h, err := readEncHeader(f)
+	if err != nil {
+		return false, err
+	}
+	if h.keyID == keyRing.id {
+		return false, nil
+	}
+	if _, err = f.Seek(0, io.SeekStart); err != nil {
+		return false, err
+	}
+	r, err := NewDecryptReader(f)
+	if err != nil {
+		return false, err
+	}
+	_, err = writeEncrypted(fpath, r, h.origSize)
+	return err == nil, err
+}
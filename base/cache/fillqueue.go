@@ -0,0 +1,160 @@
+package cache
+
+import (
+	"cess-cacher/logger"
+	"encoding/json"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+var QueuePath = "./cache/queue.json"
+
+type PendingFill struct {
+	Hash     string    `json:"hash"`
+	Requests int       `json:"requests"`
+	AddTime  time.Time `json:"addTime"`
+}
+
+type FillQueueStat struct {
+	Pending []PendingFill  `json:"pending"`
+	Failed  map[string]int `json:"failed"`
+}
+
+// FillQueue tracks the slices waiting to be filled, it survives restarts with the retry state of cache
+type FillQueue struct {
+	lock    sync.Mutex
+	pending map[string]PendingFill
+}
+
+func NewFillQueue() *FillQueue {
+	return &FillQueue{pending: make(map[string]PendingFill)}
+}
+
+// Add records a request of the slice, slices requested more often are resumed first after restart
+func (q *FillQueue) Add(hash string) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	p, ok := q.pending[hash]
+	if !ok {
+		p = PendingFill{Hash: hash, AddTime: time.Now()}
+	}
+	p.Requests++
+	q.pending[hash] = p
+}
+
+// Touch records another request of the slice already pending
+func (q *FillQueue) Touch(hash string) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	if p, ok := q.pending[hash]; ok {
+		p.Requests++
+		q.pending[hash] = p
+	}
+}
+
+// Pending reports whether the slice is waiting to be filled or being filled
+func (q *FillQueue) Pending(hash string) bool {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	_, ok := q.pending[hash]
+	return ok
+}
+
+func (q *FillQueue) Done(hash string) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	delete(q.pending, hash)
+}
+
+// List returns the pending fills in priority order
+func (q *FillQueue) List() []PendingFill {
+	q.lock.Lock()
+	list := make([]PendingFill, 0, len(q.pending))
+	for _, p := range q.pending {
+		list = append(list, p)
+	}
+	q.lock.Unlock()
+	sortFills(list)
+	return list
+}
+
+// sortFills orders the fills by requests, and the earlier one first when requests are equal
+func sortFills(list []PendingFill) {
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].Requests != list[j].Requests {
+			return list[i].Requests > list[j].Requests
+		}
+		return list[i].AddTime.Before(list[j].AddTime)
+	})
+}
+
+// FillDone ends the fill of slice, a failed slice is kept in cacheQueue so that requests do not queue it again
+// until the failed map is cleared, which backs off the fills failing again and again.
+func (c *Cache) FillDone(hash string, failed bool) {
+	c.fills.Done(hash)
+	if !failed {
+		c.cacheQueue.Delete(hash)
+	}
+}
+
+func (c *Cache) GetFillQueue() FillQueueStat {
+	stat := FillQueueStat{
+		Pending: c.fills.List(),
+		Failed:  make(map[string]int),
+	}
+	c.failedMap.Range(func(key, value any) bool {
+		stat.Failed[key.(string)] = value.(int)
+		return true
+	})
+	return stat
+}
+
+func (c *Cache) SaveFillQueue() error {
+	bytes, err := json.Marshal(c.GetFillQueue())
+	if err != nil {
+		return errors.Wrap(err, "save fill queue error")
+	}
+	err = os.WriteFile(QueuePath, bytes, os.ModePerm)
+	return errors.Wrap(err, "save fill queue error")
+}
+
+// RecoverFillQueue restores the retry state and resumes the pending fills saved before restart
+func (c *Cache) RecoverFillQueue() error {
+	var stat FillQueueStat
+	bytes, err := os.ReadFile(QueuePath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return errors.Wrap(err, "recover fill queue error")
+	}
+	if err = json.Unmarshal(bytes, &stat); err != nil {
+		return errors.Wrap(err, "recover fill queue error")
+	}
+	for k, v := range stat.Failed {
+		c.failedMap.Store(k, v)
+	}
+	var list []PendingFill
+	for _, p := range stat.Pending {
+		if _, ok := c.hashMap.Load(p.Hash); ok {
+			continue
+		}
+		c.fills.lock.Lock()
+		c.fills.pending[p.Hash] = p
+		c.fills.lock.Unlock()
+		list = append(list, p)
+	}
+	sortFills(list)
+	//the queue may be shorter than the pending list, so insert them in background
+	go func() {
+		for _, p := range list {
+			c.cacheQueue.Insert(p.Hash)
+		}
+		logger.Uld.Sugar().Infof("%d pending cache files are resumed.", len(list))
+	}()
+	return nil
+}
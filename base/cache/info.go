@@ -1,21 +1,23 @@
 package cache
 
 import (
+	"cess-cacher/base/trans/tcp"
 	"cess-cacher/logger"
-	"encoding/json"
+	"cess-cacher/utils"
 	"math"
 	"os"
-	"os/exec"
 	"path"
 	"runtime"
-	"strconv"
-	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
 
 	"github.com/pkg/errors"
 	"github.com/shirou/gopsutil/v3/cpu"
+	"github.com/shirou/gopsutil/v3/disk"
+	"github.com/shirou/gopsutil/v3/load"
+	"github.com/shirou/gopsutil/v3/mem"
+	"github.com/shirou/gopsutil/v3/net"
 )
 
 type DiskStats struct {
@@ -34,11 +36,18 @@ type MemoryStats struct {
 type CPUStats struct {
 	Num      int     `json:"cpuNum"`
 	LoadAvgs float32 `json:"loadAvgs"`
+	Load1    float64 `json:"load1"`
+	Load5    float64 `json:"load5"`
+	Load15   float64 `json:"load15"`
 }
 
+// NetStats reports throughput in bytes per second,
+// Download is measured from the slices filled from miners and Upload from the slices served to users.
 type NetStats struct {
-	Download uint64 `json:"cacheSpeed"`
-	Upload   uint64 `json:"downloadSpeed"`
+	Download      uint64 `json:"cacheSpeed"`
+	Upload        uint64 `json:"downloadSpeed"`
+	InterfaceRecv uint64 `json:"interfaceRecv"`
+	InterfaceSent uint64 `json:"interfaceSent"`
 }
 
 type CacheStats struct {
@@ -53,24 +62,32 @@ type Stat struct {
 	ErrRate  float32 `json:"errRate"`
 }
 
-const FLASH_TIME = time.Minute
+const (
+	FLASH_TIME      = time.Minute
+	NET_SAMPLE_TIME = time.Second
+	NET_RATE_WINDOW = time.Minute
+)
 
 var (
-	netInfo NetStats
-	rwLock  sync.RWMutex //Ensure the synchronization of netInfo
-	cstat   *CacheStats
+	EgressMeter = utils.NewRateMeter(NET_RATE_WINDOW)
+	netInfo     NetStats
+	rwLock      sync.RWMutex //Ensure the synchronization of netInfo
+	cstat       *CacheStats
 )
 
 func (s *CacheStats) Hit(c uint64) {
 	atomic.AddUint64(s.hits, c)
+	windows.Add(STAT_HITS, c)
 }
 
 func (s *CacheStats) Miss(c uint64) {
 	atomic.AddUint64(s.misses, c)
+	windows.Add(STAT_MISSES, c)
 }
 
 func (s *CacheStats) Error(c uint64) {
 	atomic.AddUint64(s.errs, c)
+	windows.Add(STAT_ERRORS, c)
 }
 
 func (s CacheStats) GetCacheStats() Stat {
@@ -87,32 +104,33 @@ func (s CacheStats) GetCacheStats() Stat {
 	return stat
 }
 
+// GetDiskStats returns the stats of the filesystem where the cache directory is located
 func GetDiskStats() (DiskStats, error) {
 	var stats DiskStats
-	pwd, err := os.Getwd()
-	if err != nil {
-		pwd = "/opt/"
-	}
-	out, err := exec.Command("df", pwd).Output()
+	usage, err := disk.Usage(existingDir(FilesDir))
 	if err != nil {
 		logger.Uld.Sugar().Errorf("get disk stats error:%v.\n", err)
 		return stats, errors.Wrap(err, "get disk stats error")
 	}
-	tmp := strings.Fields(strings.Split(string(out), "\n")[1])
-	tmp[len(tmp)-2] = strings.Replace(tmp[len(tmp)-2], "%", "", 1)
-	data := []uint64{}
-	for i := 1; i < len(tmp)-1; i++ {
-		d, err := strconv.ParseInt(tmp[i], 10, 64)
-		if err != nil {
-			return stats, errors.Wrap(err, "get disk stat error")
+	stats.Total = usage.Total
+	stats.Used = usage.Used
+	stats.Available = usage.Free
+	stats.UseRate = float32(math.Trunc(usage.UsedPercent) / 100)
+	return stats, nil
+}
+
+// existingDir returns the nearest existing directory of dir
+func existingDir(dir string) string {
+	for {
+		if _, err := os.Stat(dir); err == nil {
+			return dir
 		}
-		data = append(data, uint64(d))
+		parent := path.Dir(dir)
+		if parent == dir {
+			return dir
+		}
+		dir = parent
 	}
-	stats.Total = data[0] * 1024
-	stats.Used = data[1] * 1024
-	stats.Available = data[2] * 1024
-	stats.UseRate = float32(data[3]) / 100
-	return stats, nil
 }
 
 func GetCacheDiskStats() DiskStats {
@@ -132,24 +150,14 @@ func GetCacheDiskStats() DiskStats {
 
 func GetMemoryStats() (MemoryStats, error) {
 	var stats MemoryStats
-	out, err := exec.Command("free").Output()
+	vm, err := mem.VirtualMemory()
 	if err != nil {
 		logger.Uld.Sugar().Errorf("get memory stats error:%v.\n", err)
 		return stats, errors.Wrap(err, "get memory stats error")
 	}
-	tmp := strings.Fields(strings.Split(string(out), "\n")[1])[1:]
-	tmp = []string{tmp[0], tmp[2], tmp[len(tmp)-1]}
-	data := make([]uint64, len(tmp))
-	for i, v := range tmp {
-		d, err := strconv.ParseInt(v, 10, 64)
-		if err != nil {
-			return stats, errors.Wrap(err, "get memory stats error")
-		}
-		data[i] = uint64(d)
-	}
-	stats.Total = data[0] * 1024
-	stats.Free = data[1] * 1024
-	stats.Available = data[2] * 1024
+	stats.Total = vm.Total
+	stats.Free = vm.Free
+	stats.Available = vm.Available
 	return stats, nil
 }
 
@@ -161,47 +169,88 @@ func GetCPUStats() (CPUStats, error) {
 		return stats, errors.Wrap(err, "get cpu stats error")
 	}
 	stats.LoadAvgs = float32(math.Trunc(rate[0]*10) / 1000)
+	avg, err := load.Avg()
+	if err != nil {
+		return stats, errors.Wrap(err, "get cpu stats error")
+	}
+	stats.Load1, stats.Load5, stats.Load15 = avg.Load1, avg.Load5, avg.Load15
 	return stats, nil
 }
 
-func GetNetStats() (NetStats, error) {
+// netCounters returns the bytes received and sent by all network interfaces
+func netCounters() (uint64, uint64, error) {
+	counters, err := net.IOCounters(false)
+	if err != nil {
+		return 0, 0, err
+	}
+	if len(counters) == 0 {
+		return 0, 0, errors.New("no network interface")
+	}
+	return counters[0].BytesRecv, counters[0].BytesSent, nil
+}
+
+// netRate returns the throughput(bytes per second) between two samples of counters
+func netRate(recv, sent, lastRecv, lastSent uint64, interval time.Duration) NetStats {
 	var stats NetStats
-	out, err := exec.Command("speedtest", "--json").Output()
+	secs := interval.Seconds()
+	if secs <= 0 {
+		return stats
+	}
+	//counters may be reset when interfaces are changed
+	if recv >= lastRecv {
+		stats.InterfaceRecv = uint64(float64(recv-lastRecv) / secs)
+	}
+	if sent >= lastSent {
+		stats.InterfaceSent = uint64(float64(sent-lastSent) / secs)
+	}
+	return stats
+}
+
+// GetNetStats samples the interface counters for NET_SAMPLE_TIME and returns the throughput
+func GetNetStats() (NetStats, error) {
+	recv, sent, err := netCounters()
 	if err != nil {
-		return stats, errors.Wrap(err, "get net stats error")
+		return NetStats{}, errors.Wrap(err, "get net stats error")
 	}
-	var data map[string]any
-	err = json.Unmarshal(out, &data)
+	time.Sleep(NET_SAMPLE_TIME)
+	nrecv, nsent, err := netCounters()
 	if err != nil {
-		return stats, errors.Wrap(err, "get net stats error")
+		return NetStats{}, errors.Wrap(err, "get net stats error")
 	}
-	stats.Download = uint64(data["download"].(float64))
-	stats.Upload = uint64(data["upload"].(float64))
+	stats := netRate(nrecv, nsent, recv, sent, NET_SAMPLE_TIME)
+	stats.Download = tcp.RecvMeter.Rate(NET_RATE_WINDOW)
+	stats.Upload = EgressMeter.Rate(NET_RATE_WINDOW)
 	return stats, nil
 }
 
 func GetNetInfo() NetStats {
 	rwLock.RLock()
-	defer rwLock.RUnlock()
-	return netInfo
+	stats := netInfo
+	rwLock.RUnlock()
+	stats.Download = tcp.RecvMeter.Rate(NET_RATE_WINDOW)
+	stats.Upload = EgressMeter.Rate(NET_RATE_WINDOW)
+	return stats
 }
 
 func UpdateNetStats() {
-	var err error
-	rwLock.Lock()
-	for {
-		if netInfo, err = GetNetStats(); err == nil {
-			break
-		}
+	recv, sent, err := netCounters()
+	if err != nil {
 		logger.Uld.Sugar().Errorf("get net stats error:%v.\n", err)
 	}
-	rwLock.Unlock()
-	for range time.NewTicker(FLASH_TIME).C {
-		stat, err := GetNetStats()
+	sampled, last := err == nil, time.Now()
+	ticker := time.NewTicker(FLASH_TIME)
+	defer ticker.Stop()
+	for range ticker.C {
+		nrecv, nsent, err := netCounters()
 		if err != nil {
 			logger.Uld.Sugar().Errorf("get net stats error:%v.\n", err)
 			continue
 		}
+		var stat NetStats
+		if sampled {
+			stat = netRate(nrecv, nsent, recv, sent, time.Since(last))
+		}
+		recv, sent, last, sampled = nrecv, nsent, time.Now(), true
 		rwLock.Lock()
 		netInfo = stat
 		rwLock.Unlock()
@@ -209,14 +258,14 @@ func UpdateNetStats() {
 }
 
 func DownloadProgressBar(fhash, shash string, size uint64) (float64, int64) {
-	fpath := path.Join(FilesDir, fhash, shash)
+	fpath := SlicePath(fhash, shash)
 	if f, err := os.Stat(fpath); err != nil {
-		return 0, int64(size) / int64(GetNetInfo().Upload+1)
+		return 0, int64(size) / int64(GetNetInfo().Download+1)
 	} else {
 		//download progress
 		progress := float64(f.Size()) / float64(size+1)
 		//estimated completion time
-		ect := int64(size-uint64(f.Size())) / int64(GetNetInfo().Upload+1)
+		ect := int64(size-uint64(f.Size())) / int64(GetNetInfo().Download+1)
 		return progress, ect
 	}
 }
@@ -0,0 +1,99 @@
+package cache
+
+import (
+	"cess-cacher/base/chain"
+	"cess-cacher/logger"
+	"strings"
+	"time"
+)
+
+const (
+	RECONCILE_TIME    = time.Hour
+	REWATCH_WAIT_TIME = time.Second * 30
+	// Reconciliations requested by blocks with undecodable events run at most once in the time
+	RECONCILE_MIN_TIME = time.Minute
+)
+
+// InvalidateFile evicts all cached slices of the file immediately
+func (c *Cache) InvalidateFile(fid string) int {
+	var count int
+	c.hashMap.Range(func(key, value any) bool {
+		hash := key.(string)
+		if !strings.HasPrefix(hash, fid+"-") {
+			return true
+		}
+		c.Delete(hash)
+		c.delQueue.Insert(hash)
+		count++
+		return true
+	})
+	return count
+}
+
+// InvalidationServer evicts the slices of files deleted on chain as soon as their blocks are finalized
+func InvalidationServer(c *Cache) {
+	if chain.GetChainCli() == nil {
+		logger.Uld.Sugar().Error("chain client is not initialized,deleted files are not watched.")
+		return
+	}
+	requests := make(chan struct{}, 1)
+	go ReconcileServer(c, requests)
+	for {
+		err := chain.GetChainCli().WatchDeletedFiles(func(fids []string, complete bool) {
+			for _, fid := range fids {
+				if count := c.InvalidateFile(fid); count > 0 {
+					logger.Uld.Sugar().Infof("file %s is deleted on chain,%d cached slices are evicted.", fid, count)
+				}
+			}
+			//deletions may be missed in the block, the cached files are checked against the chain instead
+			if !complete {
+				logger.Uld.Sugar().Error("events of finalized block can not be decoded,cached files will be reconciled.")
+				select {
+				case requests <- struct{}{}:
+				default:
+				}
+			}
+		})
+		logger.Uld.Sugar().Errorf("watch deleted files error:%v.\n", err)
+		time.Sleep(REWATCH_WAIT_TIME)
+	}
+}
+
+// ReconcileServer periodically checks the cached files against the chain,
+// in case some deletion events were missed by the invalidation server.
+// The requests of the invalidation server are served with the metadata queried afresh.
+func ReconcileServer(c *Cache, requests <-chan struct{}) {
+	ticker := time.NewTicker(RECONCILE_TIME)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			Reconcile(c, false)
+		case <-requests:
+			Reconcile(c, true)
+			//the requests of the blocks following are served together
+			time.Sleep(RECONCILE_MIN_TIME)
+		}
+	}
+}
+
+// Reconcile evicts the files not found on chain, fresh drops the cached metadata of files before checking them
+func Reconcile(c *Cache, fresh bool) {
+	fids := make(map[string]struct{})
+	c.hashMap.Range(func(key, value any) bool {
+		fids[strings.Split(key.(string), "-")[0]] = struct{}{}
+		return true
+	})
+	for fid := range fids {
+		if fresh {
+			chain.GetChainCli().InvalidateFileMetaInfo(fid)
+		}
+		_, err := chain.GetChainCli().GetFileMetaInfo(fid)
+		if !chain.IsEmpty(err) {
+			continue
+		}
+		if count := c.InvalidateFile(fid); count > 0 {
+			logger.Uld.Sugar().Infof("file %s is not found on chain,%d cached slices are evicted.", fid, count)
+		}
+	}
+}
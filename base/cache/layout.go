@@ -0,0 +1,125 @@
+package cache
+
+import (
+	"cess-cacher/config"
+	"os"
+	"path"
+
+	"github.com/pkg/errors"
+)
+
+// length of the file hash used as the name of file directory
+const FILE_HASH_LEN = 64
+
+var (
+	// DirLevels is the number of fan-out directory levels above the file directory,
+	// e.g. with 2 levels and width 2 a slice is stored as FilesDir/ab/cd/<fileHash>/<sliceId>
+	DirLevels = 0
+	DirWidth  = 2
+)
+
+func setLayout(conf config.Config) {
+	if conf.DirLevels > 0 {
+		DirLevels = conf.DirLevels
+	}
+	if conf.DirWidth > 0 {
+		DirWidth = conf.DirWidth
+	}
+}
+
+// MigrateCacheLayout moves the files in the configured cache directory to the configured layout,
+// it refuses to run while a cacher is using the directory, which migrates the layout itself on start.
+func MigrateCacheLayout(conf config.Config) (int, error) {
+	setCacheDir(conf)
+	setLayout(conf)
+	lock, err := lockCacheDir()
+	if err != nil {
+		return 0, errors.Wrap(err, "migrate cache layout error")
+	}
+	if lock != nil {
+		defer lock.Close()
+	}
+	return MigrateLayout()
+}
+
+func FileDir(fid string) string {
+	dir := FilesDir
+	for i := 0; i < DirLevels && (i+1)*DirWidth <= len(fid); i++ {
+		dir = path.Join(dir, fid[i*DirWidth:(i+1)*DirWidth])
+	}
+	return path.Join(dir, fid)
+}
+
+func SlicePath(fid, sid string) string {
+	return path.Join(FileDir(fid), sid)
+}
+
+// WalkFileDirs calls fn with every file directory under root,
+// whatever layout the directories are stored in.
+func WalkFileDirs(root string, fn func(fid, dir string) error) error {
+	dirs, err := os.ReadDir(root)
+	if err != nil {
+		return errors.Wrap(err, "walk file dirs error")
+	}
+	for _, d := range dirs {
+		if !d.IsDir() {
+			continue
+		}
+		dir := path.Join(root, d.Name())
+		if len(d.Name()) == FILE_HASH_LEN {
+			err = fn(d.Name(), dir)
+		} else {
+			err = WalkFileDirs(dir, fn)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// MigrateLayout moves the file directories that are not stored in the configured layout,
+// it only renames directories, so it is fast and can be interrupted and run again safely.
+func MigrateLayout() (int, error) {
+	var count int
+	err := WalkFileDirs(FilesDir, func(fid, dir string) error {
+		target := FileDir(fid)
+		if dir == target {
+			return nil
+		}
+		if err := os.MkdirAll(path.Dir(target), 0777); err != nil {
+			return errors.Wrap(err, "migrate cache layout error")
+		}
+		if err := os.Rename(dir, target); err != nil {
+			return errors.Wrap(err, "migrate cache layout error")
+		}
+		count++
+		return nil
+	})
+	if err != nil {
+		return count, err
+	}
+	removeEmptyDirs(FilesDir)
+	return count, nil
+}
+
+func removeEmptyDirs(root string) bool {
+	dirs, err := os.ReadDir(root)
+	if err != nil {
+		return false
+	}
+	empty := true
+	for _, d := range dirs {
+		if !d.IsDir() || len(d.Name()) == FILE_HASH_LEN {
+			empty = false
+			continue
+		}
+		dir := path.Join(root, d.Name())
+		if removeEmptyDirs(dir) {
+			os.Remove(dir)
+			continue
+		}
+		empty = false
+	}
+	return empty
+}
@@ -0,0 +1,11 @@
+//go:build !unix
+
+package cache
+
+import "os"
+
+// lockCacheDir is a no-op where file locks are unsupported,
+// the commands changing the cache directory must not be run while cacher is running there.
+func lockCacheDir() (*os.File, error) {
+	return nil, nil
+}
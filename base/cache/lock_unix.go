@@ -0,0 +1,27 @@
+//go:build unix
+
+package cache
+
+import (
+	"os"
+	"syscall"
+
+	"github.com/pkg/errors"
+)
+
+// lockCacheDir takes the exclusive lock of the cache directory, it is released when the file is closed
+// or the process exits, so a crashed cacher leaves no stale lock behind.
+func lockCacheDir() (*os.File, error) {
+	f, err := os.OpenFile(LockPath, os.O_CREATE|os.O_RDWR, 0666)
+	if err != nil {
+		return nil, errors.Wrap(err, "lock cache dir error")
+	}
+	if err = syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		f.Close()
+		if errors.Is(err, syscall.EWOULDBLOCK) {
+			return nil, ERR_CacheInUse
+		}
+		return nil, errors.Wrap(err, "lock cache dir error")
+	}
+	return f, nil
+}
@@ -3,7 +3,7 @@ package cache
 import (
 	"cess-cacher/base/trans"
 	"cess-cacher/logger"
-	"encoding/json"
+	"context"
 	"os"
 	"path"
 	"strings"
@@ -11,13 +11,14 @@ import (
 	"time"
 
 	"github.com/panjf2000/ants/v2"
-	"github.com/pkg/errors"
 )
 
 const (
 	FLASH_FILE_TIME      = time.Minute
 	DEFAULT_QUEUE_SIZE   = 512
 	CLEAR_FAILEDMAP_TIME = time.Hour * 6
+	// a fill taking longer than it is cancelled
+	FILL_TIMEOUT = time.Minute * 30
 )
 
 type FileInfo struct {
@@ -25,6 +26,17 @@ type FileInfo struct {
 	LoadTime    time.Time
 	UsedCount   int
 	LastAccTime time.Time
+	ExpireTime  time.Time
+	DiskSize    uint64
+	Digest      string
+}
+
+// OnDisk returns the size of file on disk, which may be compressed
+func (info FileInfo) OnDisk() uint64 {
+	if info.DiskSize == 0 {
+		return info.Size
+	}
+	return info.DiskSize
 }
 
 type HashQueue struct {
@@ -40,14 +52,26 @@ type Cache struct {
 	delQueue   *HashQueue
 	cacheQueue *HashQueue
 	failedMap  sync.Map
+	revenue    *RevenueBook
+	blobs      *BlobStore
+	fills      *FillQueue
+	ctx        context.Context
+	cancel     context.CancelFunc
 }
 
 func NewCache(qlen int) *Cache {
 	cache := &Cache{
 		delQueue:   NewQueue(qlen),
 		cacheQueue: NewQueue(qlen),
+		revenue:    NewRevenueBook(),
+		blobs:      NewBlobStore(),
+		fills:      NewFillQueue(),
 	}
+	cache.ctx, cache.cancel = context.WithCancel(context.Background())
 	cache.LoadMetadata()
+	if err := cache.revenue.Recover(); err != nil {
+		logger.Uld.Sugar().Errorf("recover revenue book error:%v.\n", err)
+	}
 	return cache
 }
 
@@ -72,10 +96,18 @@ func (c *Cache) LoadFailedFile(shash string) (int, bool) {
 func (c *Cache) ClearFailedMap(interval time.Duration) {
 	ticker := time.NewTicker(interval)
 	for range ticker.C {
+		failed := make(map[string]struct{})
 		c.failedMap.Range(func(key, value any) bool {
+			failed[key.(string)] = struct{}{}
 			c.failedMap.Delete(key)
 			return true
 		})
+		//the failed slices can be queued again
+		c.cacheQueue.DeleteFunc(func(hash string) bool {
+			_, sid, _ := strings.Cut(hash, "-")
+			_, ok := failed[sid]
+			return ok
+		})
 	}
 
 }
@@ -113,7 +145,13 @@ func (c *Cache) QueryFile(hash string) (FileInfo, bool) {
 	}
 }
 
-func (c *Cache) LoadInCache(hash string, size uint64) {
+func (c *Cache) LoadInCache(hash string, size, diskSize uint64) {
+	c.LoadBlobInCache(hash, size, diskSize, "")
+}
+
+// LoadBlobInCache loads a slice whose content is stored as the blob of digest,
+// the disk space of blob is only counted once however many slices refer to it.
+func (c *Cache) LoadBlobInCache(hash string, size, diskSize uint64, digest string) {
 	if size <= 0 {
 		return
 	}
@@ -122,28 +160,43 @@ func (c *Cache) LoadInCache(hash string, size uint64) {
 		LoadTime:    time.Now(),
 		UsedCount:   1,
 		LastAccTime: time.Now(),
+		DiskSize:    diskSize,
+		Digest:      digest,
 	}
+	info.ExpireTime = ExpireTime(hash, info.LoadTime)
+	c.rw.Lock()
+	defer c.rw.Unlock()
+	//acquire before release, so that a blob is not removed when the same slice is reloaded
+	c.size += c.acquire(info)
 	if v, ok := c.hashMap.Load(hash); ok {
-		if v.(FileInfo).Size != size {
-			c.rw.Lock()
-			c.size = c.size - v.(FileInfo).Size + size
-			c.rw.Unlock()
-		}
-	} else {
-		c.rw.Lock()
-		c.size = c.size + size
-		c.rw.Unlock()
+		c.size -= c.release(hash, v.(FileInfo))
 	}
 	c.hashMap.Store(hash, info)
 }
 
-func (c *Cache) Delete(hash string) {
+// Access records a hit of the cached file
+func (c *Cache) Access(hash string) {
+	c.rw.Lock()
+	defer c.rw.Unlock()
+	if v, ok := c.hashMap.Load(hash); ok {
+		info := v.(FileInfo)
+		info.UsedCount++
+		info.LastAccTime = time.Now()
+		c.hashMap.Store(hash, info)
+	}
+}
+
+// Delete drops the file from index and returns the disk space freed once its file is removed
+func (c *Cache) Delete(hash string) uint64 {
 	c.rw.Lock()
 	defer c.rw.Unlock()
 	v, ok := c.hashMap.LoadAndDelete(hash)
-	if ok {
-		c.size -= v.(FileInfo).Size
+	if !ok {
+		return 0
 	}
+	freed := c.release(hash, v.(FileInfo))
+	c.size -= freed
+	return freed
 }
 
 func NewQueue(size int) *HashQueue {
@@ -177,6 +230,17 @@ func (q *HashQueue) Delete(hash string) {
 	q.rw.Unlock()
 }
 
+// DeleteFunc deletes the hashs for which fn returns true
+func (q *HashQueue) DeleteFunc(fn func(hash string) bool) {
+	q.rw.Lock()
+	defer q.rw.Unlock()
+	for hash := range q.filter {
+		if fn(hash) {
+			delete(q.filter, hash)
+		}
+	}
+}
+
 func (q *HashQueue) Query(hash string) bool {
 	q.rw.RLock()
 	defer q.rw.RUnlock()
@@ -185,15 +249,9 @@ func (q *HashQueue) Query(hash string) bool {
 }
 
 func (c *Cache) LoadMetadata() {
-	var list map[string]FileInfo
-	bytes, err := os.ReadFile(FilePath)
+	list, err := readMetadata()
 	if err != nil {
-		logger.Uld.Sugar().Errorf("read metadata file error:%v.\n", err)
-		os.Exit(1)
-	}
-	err = json.Unmarshal(bytes, &list)
-	if err != nil {
-		logger.Uld.Sugar().Errorf("unmarshal metadata file error:%v.\n", err)
+		logger.Uld.Sugar().Errorf("load metadata file error:%v.\n", err)
 		os.Exit(1)
 	}
 	var size uint64
@@ -202,8 +260,16 @@ func (c *Cache) LoadMetadata() {
 		if CheckBadFileAndDel(paths[0], paths[1]) {
 			continue
 		}
+		//slices may be compressed or encrypted by commands while cacher is stopped
+		if _, diskSize, err := SliceSize(paths[0], paths[1]); err == nil {
+			v.DiskSize = diskSize
+		}
+		//expired files will be cleaned by the expire server
+		if v.ExpireTime.IsZero() {
+			v.ExpireTime = ExpireTime(k, v.LoadTime)
+		}
 		c.hashMap.Store(k, v)
-		size += v.Size
+		size += c.acquire(v)
 	}
 	c.rw.Lock()
 	c.size = size
@@ -216,12 +282,29 @@ func (c *Cache) SaveMetadata() error {
 		list[key.(string)] = value.(FileInfo)
 		return true
 	})
-	bytes, err := json.Marshal(list)
-	if err != nil {
-		return errors.Wrap(err, "save hash list error")
+	return writeMetadata(list)
+}
+
+// Shutdown saves the state of cache and cancels the running fills,
+// the cancelled fills are resumed from the saved fill queue after restart.
+func (c *Cache) Shutdown() {
+	if err := c.SaveMetadata(); err != nil {
+		logger.Uld.Sugar().Errorf("save metadata file error:%v.\n", err)
 	}
-	err = os.WriteFile(FilePath, bytes, os.ModePerm)
-	return errors.Wrap(err, "save hash list error")
+	if err := c.SaveFillQueue(); err != nil {
+		logger.Uld.Sugar().Errorf("save fill queue error:%v.\n", err)
+	}
+	if err := windows.Save(); err != nil {
+		logger.Uld.Sugar().Errorf("save window stats error:%v.\n", err)
+	}
+	if err := c.revenue.Save(); err != nil {
+		logger.Uld.Sugar().Errorf("save revenue book error:%v.\n", err)
+	}
+	if err := c.SnapshotAccess(); err != nil {
+		logger.Uld.Sugar().Errorf("snapshot access error:%v.\n", err)
+	}
+	c.cancel()
+	trans.ClosePool()
 }
 
 func (c *Cache) FlashMetadataFile() {
@@ -231,42 +314,120 @@ func (c *Cache) FlashMetadataFile() {
 		if err := c.SaveMetadata(); err != nil {
 			logger.Uld.Sugar().Errorf("save metadata file error:%v.\n", err)
 		}
+		if err := c.SaveFillQueue(); err != nil {
+			logger.Uld.Sugar().Errorf("save fill queue error:%v.\n", err)
+		}
+		if err := windows.Save(); err != nil {
+			logger.Uld.Sugar().Errorf("save window stats error:%v.\n", err)
+		}
+		if err := c.revenue.Save(); err != nil {
+			logger.Uld.Sugar().Errorf("save revenue book error:%v.\n", err)
+		}
 	}
 }
 
 func (c *Cache) CacheFileServer() {
 	go c.ClearFailedMap(CLEAR_FAILEDMAP_TIME)
+	go c.revenue.ClearServer()
+	go c.ExpireServer()
 	lockMap := sync.Map{}
 	for h := range c.cacheQueue.GetQueue() {
 		hash := h
 		paths := strings.Split(hash, "-")
-		dir := path.Join(FilesDir, paths[0])
+		dir := FileDir(paths[0])
 		if _, err := os.Stat(dir); err != nil {
-			if err = os.Mkdir(dir, 0777); err != nil {
+			if err = os.MkdirAll(dir, 0777); err != nil {
+				c.AddFailedFile(paths[1])
+				c.FillDone(hash, true)
 				continue
 			}
 		}
 		if _, ok := lockMap.Load(hash); ok {
 			continue
 		}
-		if _, err := os.Stat(path.Join(dir, paths[1])); err != nil {
+		if _, err := LocateSlice(paths[0], paths[1]); err != nil {
 			ants.Submit(func() {
+				start := time.Now()
 				lockMap.Store(hash, struct{}{})
 				defer lockMap.Delete(hash)
-				err := trans.DownloadFile(paths[0], dir, paths[1])
+				//failed fills are recorded in the failed map, the success clears it
+				defer func() {
+					_, failed := c.LoadFailedFile(paths[1])
+					c.FillDone(hash, failed)
+				}()
+				//the slices of all sources are checked against the size on chain before they are indexed
+				size, err := GetSliceSize(paths[0], paths[1])
+				if err != nil {
+					c.AddFailedFile(paths[1])
+					logger.Uld.Sugar().Errorf("get size of file %s error:%v.\n", hash, err)
+					return
+				}
+				ctx, cancel := context.WithTimeout(c.ctx, FILL_TIMEOUT)
+				defer cancel()
+				err = trans.Fill(ctx, paths[0], dir, paths[1], size)
 				if err != nil {
 					c.AddFailedFile(paths[1])
-					logger.Uld.Sugar().Errorf("download file %s from storage error:%v.\n", hash, err)
+					logger.Uld.Sugar().Errorf("download file %s from sources error:%v.\n", hash, err)
 					return
 				}
-				fs, err := os.Stat(path.Join(dir, paths[1]))
+				fpath := path.Join(dir, paths[1])
+				fs, err := os.Stat(fpath)
 				if err != nil {
 					c.AddFailedFile(paths[1])
 					logger.Uld.Sugar().Errorf("get size of file %s error:%v.\n", hash, err)
 					return
 				}
-				c.LoadInCache(hash, uint64(fs.Size()))
+				var (
+					digest string
+					linked bool
+				)
+				diskSize := uint64(fs.Size())
+				if Dedup {
+					if digest, err = FileDigest(fpath); err != nil {
+						c.AddFailedFile(paths[1])
+						logger.Uld.Sugar().Errorf("get digest of file %s error:%v.\n", hash, err)
+						return
+					}
+					fpath, linked = LinkBlob(digest, fpath)
+				}
+				if linked {
+					//the blob has been compressed or encrypted when it was stored
+					if _, diskSize, err = SliceSize(paths[0], paths[1]); err != nil {
+						c.AddFailedFile(paths[1])
+						logger.Uld.Sugar().Errorf("get size of file %s error:%v.\n", hash, err)
+						return
+					}
+					c.LoadBlobInCache(hash, uint64(fs.Size()), diskSize, digest)
+					c.DelFailedFile(paths[1])
+					windows.Fill(uint64(fs.Size()), time.Since(start))
+					return
+				}
+				if Compress {
+					if fpath, diskSize, err = CompressSlice(fpath); err != nil {
+						c.AddFailedFile(paths[1])
+						logger.Uld.Sugar().Errorf("compress file %s error:%v.\n", hash, err)
+						return
+					}
+				}
+				if Encrypt {
+					if fpath, diskSize, err = EncryptSlice(fpath, uint64(fs.Size())); err != nil {
+						c.AddFailedFile(paths[1])
+						logger.Uld.Sugar().Errorf("encrypt file %s error:%v.\n", hash, err)
+						return
+					}
+				}
+				if Dedup {
+					if err = SaveBlob(digest, SlicePath(paths[0], paths[1]), fpath); err != nil {
+						logger.Uld.Sugar().Errorf("save blob of file %s error:%v.\n", hash, err)
+						digest = ""
+					}
+				}
+				c.LoadBlobInCache(hash, uint64(fs.Size()), diskSize, digest)
+				c.DelFailedFile(paths[1])
+				windows.Fill(uint64(fs.Size()), time.Since(start))
 			})
+		} else {
+			c.FillDone(hash, false)
 		}
 	}
 }
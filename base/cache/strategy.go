@@ -25,6 +25,7 @@ type Item struct {
 	Size     uint64
 	Count    int
 	Interval time.Duration
+	Earnings uint64
 }
 
 type LruQueue []Item
@@ -57,11 +58,11 @@ func GetRandomList(c *Cache, pickSize uint64) []Item {
 				check[k] = struct{}{}
 				randList = append(randList, Item{
 					Hash:     k,
-					Size:     v.Size,
+					Size:     v.OnDisk(),
 					Count:    v.UsedCount,
 					Interval: now.Sub(v.LastAccTime),
 				})
-				size += v.Size
+				size += v.OnDisk()
 			}
 			return true
 		})
@@ -84,9 +85,9 @@ func RandomLRU(c *Cache, cleanSize uint64) {
 		if size >= cleanSize {
 			break
 		}
-		size += v.Size
-		c.Delete(v.Hash)
+		size += c.Delete(v.Hash)
 		c.delQueue.Insert(v.Hash)
+		windows.Add(STAT_EVICTIONS, 1)
 	}
 }
 
@@ -97,54 +98,63 @@ func StrategyServer(c *Cache) {
 		used := c.TotalSize()
 		if used >= uint64(float64(MaxCacheSize)*MaxCacheRate) {
 			logger.Uld.Sugar().Info("cache strategy working...")
+			if EconomicMode {
+				RevenueLRU(c, used-uint64(float64(MaxCacheSize)*Threshold))
+				continue
+			}
 			RandomLRU(c, used-uint64(float64(MaxCacheSize)*Threshold))
 		}
 	}
 }
 
 func Reorganizate(c *Cache) error {
-	dirs, err := os.ReadDir(FilesDir)
-	if err != nil {
-		return errors.Wrap(err, "reorganizate cache error")
-	}
-	for _, dir := range dirs {
-		if !dir.IsDir() {
-			continue
-		}
-		df, err := os.ReadDir(path.Join(FilesDir, dir.Name()))
+	err := WalkFileDirs(FilesDir, func(fid, dir string) error {
+		df, err := os.ReadDir(dir)
 		if err != nil {
-			return errors.Wrap(err, "reorganizate cache error")
+			return err
 		}
 		for _, f := range df {
-			if _, ok := c.hashMap.Load(dir.Name() + "-" + f.Name()); f.IsDir() || ok {
+			if f.IsDir() {
 				continue
 			}
-			if CheckBadFileAndDel(dir.Name(), f.Name()) {
+			//remove the residue of interrupted compression or encryption
+			if strings.HasSuffix(f.Name(), TEMP_SUFFIX) {
+				os.Remove(path.Join(dir, f.Name()))
 				continue
 			}
-			var size uint64
-			if i, err := f.Info(); err == nil {
-				size = uint64(i.Size())
+			sid := TrimSliceSuffix(f.Name())
+			if _, ok := c.hashMap.Load(fid + "-" + sid); ok {
+				continue
 			}
-			c.LoadInCache(dir.Name()+"-"+f.Name(), size)
+			if CheckBadFileAndDel(fid, sid) {
+				continue
+			}
+			size, diskSize, err := SliceSize(fid, sid)
+			if err != nil {
+				continue
+			}
+			c.LoadInCache(fid+"-"+sid, size, diskSize)
 		}
-	}
-	return nil
+		return nil
+	})
+	return errors.Wrap(err, "reorganizate cache error")
 }
 
 func CleanCacheServer(c *Cache) {
 	for h := range c.delQueue.GetQueue() {
 		hash := h
 		if _, ok := c.hashMap.Load(hash); ok {
+			c.blobs.Free(hash)
 			continue
 		}
 		paths := strings.Split(hash, "-")
 		err := ants.Submit(func() {
-			if err := os.Remove(path.Join(FilesDir, paths[0], paths[1])); err != nil {
+			if err := RemoveSlice(paths[0], paths[1]); err != nil {
 				logger.Uld.Sugar().Errorf("reomve cache file %s error:%v.\n", hash, err)
 				c.delQueue.Insert(hash)
 				return
 			}
+			c.blobs.Free(hash)
 			c.delQueue.Delete(hash)
 		})
 		if err != nil {
@@ -0,0 +1,68 @@
+package cache
+
+import (
+	"cess-cacher/logger"
+	"strings"
+	"sync"
+	"time"
+)
+
+const TTL_SWEEP_TIME = time.Minute
+
+var (
+	DefaultTTL time.Duration = 0
+	fileTTL    sync.Map
+)
+
+// SetFileTTL overrides the default TTL of all slices of a file,
+// a TTL less than or equal to 0 means the slices never expire.
+func SetFileTTL(fhash string, ttl time.Duration) {
+	fileTTL.Store(fhash, ttl)
+}
+
+func GetTTL(hash string) time.Duration {
+	fhash := strings.Split(hash, "-")[0]
+	if v, ok := fileTTL.Load(fhash); ok {
+		return v.(time.Duration)
+	}
+	return DefaultTTL
+}
+
+func ExpireTime(hash string, from time.Time) time.Time {
+	ttl := GetTTL(hash)
+	if ttl <= 0 {
+		return time.Time{}
+	}
+	return from.Add(ttl)
+}
+
+func (info FileInfo) IsExpired() bool {
+	return !info.ExpireTime.IsZero() && time.Since(info.ExpireTime) >= 0
+}
+
+// SweepExpired removes expired slices from the cache index and hands them to delQueue
+func (c *Cache) SweepExpired() int {
+	var count int
+	c.hashMap.Range(func(key, value any) bool {
+		if !value.(FileInfo).IsExpired() {
+			return true
+		}
+		hash := key.(string)
+		c.Delete(hash)
+		c.delQueue.Insert(hash)
+		windows.Add(STAT_EVICTIONS, 1)
+		count++
+		return true
+	})
+	return count
+}
+
+func (c *Cache) ExpireServer() {
+	ticker := time.NewTicker(TTL_SWEEP_TIME)
+	defer ticker.Stop()
+	for range ticker.C {
+		if count := c.SweepExpired(); count > 0 {
+			logger.Uld.Sugar().Infof("%d expired cache files are cleaned.", count)
+		}
+	}
+}
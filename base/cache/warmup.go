@@ -0,0 +1,220 @@
+package cache
+
+import (
+	"cess-cacher/base/cluster"
+	"cess-cacher/config"
+	"cess-cacher/logger"
+	"encoding/json"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	WARMUP_SNAPSHOT_TIME = time.Minute * 10
+	DEFAULT_WARMUP_TOP   = 1024
+	WARMUP_READ_CHUNK    = 1024 * 1024
+	// interval of checking whether the fill of warm up ends
+	WARMUP_POLL_TIME = time.Millisecond * 200
+)
+
+var (
+	WarmUpPath = "./cache/warmup.json"
+	WarmUpTop  = DEFAULT_WARMUP_TOP
+	WarmUpRate uint64
+)
+
+type AccessRecord struct {
+	Hash      string    `json:"hash"`
+	UsedCount int       `json:"usedCount"`
+	Size      uint64    `json:"size"`
+	AccTime   time.Time `json:"accTime"`
+}
+
+// sortByHotness orders the hashs by used count, and the recently accessed one first when counts are equal
+func sortByHotness(hashs []string, list map[string]FileInfo) {
+	sort.Slice(hashs, func(i, j int) bool {
+		a, b := list[hashs[i]], list[hashs[j]]
+		if a.UsedCount != b.UsedCount {
+			return a.UsedCount > b.UsedCount
+		}
+		return a.LastAccTime.After(b.LastAccTime)
+	})
+}
+
+func initWarmUp(conf config.Config, c *Cache) {
+	if conf.WarmUpTop > 0 {
+		WarmUpTop = conf.WarmUpTop
+	}
+	WarmUpRate = conf.WarmUpRate
+	//the snapshot must be loaded before it is overwritten by the snapshot server
+	if conf.WarmUp {
+		records, err := LoadAccessSnapshot()
+		if err != nil {
+			logger.Uld.Sugar().Errorf("load access snapshot error:%v.\n", err)
+		} else if len(records) > 0 {
+			go c.WarmUp(records)
+		}
+	}
+	go c.SnapshotServer()
+}
+
+// SnapshotAccess records the top accessed slices, they are warmed up when cacher restarts
+func (c *Cache) SnapshotAccess() error {
+	list := make(map[string]FileInfo)
+	var hashs []string
+	c.hashMap.Range(func(key, value any) bool {
+		list[key.(string)] = value.(FileInfo)
+		hashs = append(hashs, key.(string))
+		return true
+	})
+	sortByHotness(hashs, list)
+	if len(hashs) > WarmUpTop {
+		hashs = hashs[:WarmUpTop]
+	}
+	records := make([]AccessRecord, 0, len(hashs))
+	for _, h := range hashs {
+		records = append(records, AccessRecord{
+			Hash:      h,
+			UsedCount: list[h].UsedCount,
+			Size:      list[h].Size,
+			AccTime:   list[h].LastAccTime,
+		})
+	}
+	bytes, err := json.Marshal(records)
+	if err != nil {
+		return errors.Wrap(err, "snapshot access error")
+	}
+	err = os.WriteFile(WarmUpPath, bytes, os.ModePerm)
+	return errors.Wrap(err, "snapshot access error")
+}
+
+func (c *Cache) SnapshotServer() {
+	ticker := time.NewTicker(WARMUP_SNAPSHOT_TIME)
+	defer ticker.Stop()
+	for range ticker.C {
+		if err := c.SnapshotAccess(); err != nil {
+			logger.Uld.Sugar().Errorf("snapshot access error:%v.\n", err)
+		}
+	}
+}
+
+func LoadAccessSnapshot() ([]AccessRecord, error) {
+	var records []AccessRecord
+	bytes, err := os.ReadFile(WarmUpPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, errors.Wrap(err, "load access snapshot error")
+	}
+	err = json.Unmarshal(bytes, &records)
+	return records, errors.Wrap(err, "load access snapshot error")
+}
+
+// WarmUp reloads the slices of the access snapshot in background,
+// cached slices are read into the page cache and evicted ones are fetched again one by one,
+// both are limited to WarmUpRate bytes per second.
+func (c *Cache) WarmUp(records []AccessRecord) {
+	limiter := newRateLimiter(WarmUpRate)
+	var promoted, fetched int
+	for _, r := range records {
+		paths := strings.Split(r.Hash, "-")
+		if len(paths) != 2 {
+			continue
+		}
+		if _, ok := c.hashMap.Load(r.Hash); ok {
+			if err := promoteSlice(paths[0], paths[1], limiter); err != nil {
+				logger.Uld.Sugar().Errorf("warm up file %s error:%v.\n", r.Hash, err)
+				continue
+			}
+			promoted++
+			continue
+		}
+		//the slices evicted are only fetched again by their owners in cluster,
+		//and the ones queued by requests meanwhile are left to the requests
+		if _, self := cluster.Owner(r.Hash); !self || c.cacheQueue.Query(r.Hash) {
+			continue
+		}
+		downloading, err := CheckAndCacheFile(r.Hash)
+		if err != nil {
+			logger.Uld.Sugar().Errorf("warm up file %s error:%v.\n", r.Hash, err)
+			continue
+		}
+		//the next fill starts after this one ends, so the bytes fetched are limited
+		if downloading && !c.waitFill(r.Hash) {
+			break
+		}
+		info, ok := c.QueryFile(r.Hash)
+		if !ok {
+			continue
+		}
+		if downloading {
+			limiter.Wait(info.Size)
+		}
+		fetched++
+	}
+	logger.Uld.Sugar().Infof("cache warm up done, %d files promoted, %d files fetched.", promoted, fetched)
+}
+
+// waitFill waits until the fill of slice ends, it returns false if the cache is shut down meanwhile
+func (c *Cache) waitFill(hash string) bool {
+	ticker := time.NewTicker(WARMUP_POLL_TIME)
+	defer ticker.Stop()
+	for c.fills.Pending(hash) {
+		select {
+		case <-c.ctx.Done():
+			return false
+		case <-ticker.C:
+		}
+	}
+	return true
+}
+
+func promoteSlice(fid, sid string, limiter *rateLimiter) error {
+	fpath, err := LocateSlice(fid, sid)
+	if err != nil {
+		return err
+	}
+	f, err := os.Open(fpath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	for {
+		n, err := io.CopyN(io.Discard, f, WARMUP_READ_CHUNK)
+		limiter.Wait(uint64(n))
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// rateLimiter paces the warm up, rate 0 means no limit
+type rateLimiter struct {
+	rate  uint64
+	start time.Time
+	total uint64
+}
+
+func newRateLimiter(rate uint64) *rateLimiter {
+	return &rateLimiter{rate: rate, start: time.Now()}
+}
+
+func (l *rateLimiter) Wait(n uint64) {
+	if l.rate == 0 {
+		return
+	}
+	l.total += n
+	due := l.start.Add(time.Duration(float64(l.total) / float64(l.rate) * float64(time.Second)))
+	if d := time.Until(due); d > 0 {
+		time.Sleep(d)
+	}
+}
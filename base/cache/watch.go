@@ -0,0 +1,91 @@
+package cache
+
+import (
+	"cess-cacher/logger"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const RESCAN_TIME = time.Minute * 5
+
+var ERR_WatchUnsupported = errors.New("file watching is unsupported")
+
+// WatchServer keeps the index in sync with the files changed by other processes,
+// it falls back to rescanning FilesDir periodically when the files can not be watched.
+func WatchServer(c *Cache) {
+	err := watchFiles(c)
+	logger.Uld.Sugar().Errorf("watch cache files error:%v, rescan them every %v instead.\n", err, RESCAN_TIME)
+	ticker := time.NewTicker(RESCAN_TIME)
+	defer ticker.Stop()
+	for range ticker.C {
+		c.Rescan()
+	}
+}
+
+// Rescan checks all indexed slices and all files in FilesDir
+func (c *Cache) Rescan() {
+	c.hashMap.Range(func(key, value any) bool {
+		paths := strings.Split(key.(string), "-")
+		c.syncSlice(paths[0], paths[1])
+		return true
+	})
+	err := WalkFileDirs(FilesDir, func(fid, dir string) error {
+		c.syncDir(fid, dir)
+		return nil
+	})
+	if err != nil {
+		logger.Uld.Sugar().Errorf("rescan cache files error:%v.\n", err)
+	}
+}
+
+func (c *Cache) syncDir(fid, dir string) {
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		return
+	}
+	for _, f := range files {
+		if f.IsDir() || strings.HasSuffix(f.Name(), TEMP_SUFFIX) {
+			continue
+		}
+		sid := TrimSliceSuffix(f.Name())
+		if _, ok := c.hashMap.Load(fid + "-" + sid); ok {
+			continue
+		}
+		c.syncSlice(fid, sid)
+	}
+}
+
+// syncSlice updates the index entry of slice according to the file on disk,
+// slices being filled are skipped, the fill server will load them.
+func (c *Cache) syncSlice(fid, sid string) {
+	hash := fid + "-" + sid
+	if c.cacheQueue.Query(hash) {
+		return
+	}
+	info, indexed := c.QueryFile(hash)
+	size, diskSize, err := SliceSize(fid, sid)
+	if err != nil {
+		if indexed {
+			c.Delete(hash)
+			c.blobs.Free(hash)
+			logger.Uld.Sugar().Infof("cache file %s is removed externally.", hash)
+		}
+		return
+	}
+	if indexed && info.Size == size {
+		return
+	}
+	if CheckBadFileAndDel(fid, sid) {
+		if indexed {
+			c.Delete(hash)
+			c.blobs.Free(hash)
+			logger.Uld.Sugar().Infof("cache file %s is modified externally and removed.", hash)
+		}
+		return
+	}
+	c.LoadInCache(hash, size, diskSize)
+	logger.Uld.Sugar().Infof("cache file %s is added externally.", hash)
+}
@@ -0,0 +1,123 @@
+//go:build linux
+
+package cache
+
+import (
+	"cess-cacher/logger"
+	"os"
+	"path"
+	"strings"
+	"syscall"
+	"unsafe"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	WATCH_MASK = syscall.IN_CREATE | syscall.IN_CLOSE_WRITE | syscall.IN_MODIFY |
+		syscall.IN_DELETE | syscall.IN_MOVED_FROM | syscall.IN_MOVED_TO
+	WATCH_BUFFER_SIZE = 64 * 1024
+)
+
+type inotify struct {
+	fd   int
+	dirs map[int32]string
+}
+
+// watchFiles watches FilesDir and its subdirectories with inotify, it only returns on error
+func watchFiles(c *Cache) error {
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC)
+	if err != nil {
+		return errors.Wrap(err, "init inotify error")
+	}
+	defer syscall.Close(fd)
+	w := &inotify{fd: fd, dirs: make(map[int32]string)}
+	if err = w.addTree(FilesDir); err != nil {
+		return err
+	}
+	buf := make([]byte, WATCH_BUFFER_SIZE)
+	for {
+		n, err := syscall.Read(fd, buf)
+		if err == syscall.EINTR {
+			continue
+		}
+		if err != nil {
+			return errors.Wrap(err, "read inotify events error")
+		}
+		for off := 0; off+syscall.SizeofInotifyEvent <= n; {
+			ev := (*syscall.InotifyEvent)(unsafe.Pointer(&buf[off]))
+			name := strings.TrimRight(string(buf[off+syscall.SizeofInotifyEvent:off+syscall.SizeofInotifyEvent+int(ev.Len)]), "\x00")
+			off += syscall.SizeofInotifyEvent + int(ev.Len)
+			w.handle(c, ev, name)
+		}
+	}
+}
+
+func (w *inotify) addTree(root string) error {
+	wd, err := syscall.InotifyAddWatch(w.fd, root, WATCH_MASK)
+	if err != nil {
+		return errors.Wrap(err, "add inotify watch error")
+	}
+	w.dirs[int32(wd)] = root
+	dirs, err := os.ReadDir(root)
+	if err != nil {
+		return errors.Wrap(err, "add inotify watch error")
+	}
+	for _, d := range dirs {
+		if !d.IsDir() {
+			continue
+		}
+		if err = w.addTree(path.Join(root, d.Name())); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (w *inotify) handle(c *Cache, ev *syscall.InotifyEvent, name string) {
+	//events are lost, so all files have to be checked
+	if ev.Mask&syscall.IN_Q_OVERFLOW != 0 {
+		c.Rescan()
+		return
+	}
+	if ev.Mask&syscall.IN_IGNORED != 0 {
+		delete(w.dirs, ev.Wd)
+		return
+	}
+	dir, ok := w.dirs[ev.Wd]
+	if !ok || name == "" {
+		return
+	}
+	fpath := path.Join(dir, name)
+	if ev.Mask&syscall.IN_ISDIR != 0 {
+		if ev.Mask&(syscall.IN_CREATE|syscall.IN_MOVED_TO) != 0 {
+			//files may be added before the directory is watched
+			if err := w.addTree(fpath); err != nil {
+				logger.Uld.Sugar().Errorf("watch directory %s error:%v.\n", fpath, err)
+			}
+			if len(name) == FILE_HASH_LEN {
+				c.syncDir(name, fpath)
+				return
+			}
+			WalkFileDirs(fpath, func(fid, dir string) error {
+				c.syncDir(fid, dir)
+				return nil
+			})
+		} else if ev.Mask&(syscall.IN_DELETE|syscall.IN_MOVED_FROM) != 0 {
+			c.Rescan()
+		}
+		return
+	}
+	fid := path.Base(dir)
+	if len(fid) != FILE_HASH_LEN || strings.HasSuffix(name, TEMP_SUFFIX) {
+		return
+	}
+	sid := TrimSliceSuffix(name)
+	//files are written in many pieces, only the indexed ones are checked for truncation
+	if ev.Mask&syscall.IN_MODIFY != 0 {
+		if _, ok := c.hashMap.Load(fid + "-" + sid); !ok {
+			return
+		}
+	}
+	c.syncSlice(fid, sid)
+}
@@ -0,0 +1,7 @@
+//go:build !linux
+
+package cache
+
+func watchFiles(c *Cache) error {
+	return ERR_WatchUnsupported
+}
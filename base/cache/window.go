@@ -0,0 +1,234 @@
+package cache
+
+import (
+	"cess-cacher/logger"
+	"encoding/json"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// granularity of windowed statistics
+	STAT_BUCKET_TIME = time.Second * 10
+	// the longest window, older statistics are dropped
+	STAT_HISTORY_TIME = time.Hour * 24
+	// bins of the fill latency histogram, one more than LatencyBounds
+	LATENCY_BINS = 16
+)
+
+const (
+	STAT_HITS = iota
+	STAT_MISSES
+	STAT_ERRORS
+	STAT_BYTES_SERVED
+	STAT_BYTES_FILLED
+	STAT_EVICTIONS
+	STAT_FILLS
+	STAT_COUNTERS
+)
+
+var (
+	StatsPath   = "./cache/stats.json"
+	StatWindows = []time.Duration{time.Minute, time.Minute * 5, time.Hour, time.Hour * 24}
+	// upper bounds of the fill latency histogram, the last bin holds the longer ones
+	LatencyBounds = []time.Duration{
+		time.Millisecond * 50, time.Millisecond * 100, time.Millisecond * 250, time.Millisecond * 500,
+		time.Second, time.Second * 2, time.Second * 5, time.Second * 10, time.Second * 20, time.Second * 30,
+		time.Minute, time.Minute * 2, time.Minute * 5, time.Minute * 10, time.Minute * 30,
+	}
+	windows = NewWindowStats()
+)
+
+type statBucket struct {
+	Stamp    int64                 `json:"stamp"`
+	Counters [STAT_COUNTERS]uint64 `json:"counters"`
+	Latency  [LATENCY_BINS]uint32  `json:"latency"`
+}
+
+type WindowStat struct {
+	Window        string  `json:"window"`
+	Hits          uint64  `json:"hits"`
+	Misses        uint64  `json:"misses"`
+	Errors        uint64  `json:"errors"`
+	HitRate       float32 `json:"hitRate"`
+	BytesServed   uint64  `json:"bytesServed"`
+	BytesFilled   uint64  `json:"bytesFilled"`
+	Evictions     uint64  `json:"evictions"`
+	Fills         uint64  `json:"fills"`
+	FillLatency50 int64   `json:"fillLatencyP50"`
+	FillLatency90 int64   `json:"fillLatencyP90"`
+	FillLatency99 int64   `json:"fillLatencyP99"`
+}
+
+// WindowStats keeps the statistics of the latest day in buckets of STAT_BUCKET_TIME
+type WindowStats struct {
+	lock    sync.Mutex
+	buckets []statBucket
+}
+
+func NewWindowStats() *WindowStats {
+	return &WindowStats{
+		buckets: make([]statBucket, STAT_HISTORY_TIME/STAT_BUCKET_TIME),
+	}
+}
+
+// bucket returns the bucket of the time, the caller must hold the lock
+func (w *WindowStats) bucket(t time.Time) *statBucket {
+	stamp := t.Unix() / int64(STAT_BUCKET_TIME/time.Second)
+	b := &w.buckets[stamp%int64(len(w.buckets))]
+	if b.Stamp != stamp {
+		*b = statBucket{Stamp: stamp}
+	}
+	return b
+}
+
+func (w *WindowStats) Add(counter int, n uint64) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	w.bucket(time.Now()).Counters[counter] += n
+}
+
+// Fill records a finished fill with its size and latency
+func (w *WindowStats) Fill(size uint64, latency time.Duration) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	b := w.bucket(time.Now())
+	b.Counters[STAT_FILLS]++
+	b.Counters[STAT_BYTES_FILLED] += size
+	i := 0
+	for i < len(LatencyBounds) && latency > LatencyBounds[i] {
+		i++
+	}
+	b.Latency[i]++
+}
+
+func (w *WindowStats) Stat(window time.Duration) WindowStat {
+	var (
+		counters [STAT_COUNTERS]uint64
+		latency  [LATENCY_BINS]uint32
+	)
+	from := time.Now().Add(-window).Unix() / int64(STAT_BUCKET_TIME/time.Second)
+	w.lock.Lock()
+	for _, b := range w.buckets {
+		if b.Stamp <= from {
+			continue
+		}
+		for i, v := range b.Counters {
+			counters[i] += v
+		}
+		for i, v := range b.Latency {
+			latency[i] += v
+		}
+	}
+	w.lock.Unlock()
+	stat := WindowStat{
+		Window:        window.String(),
+		Hits:          counters[STAT_HITS],
+		Misses:        counters[STAT_MISSES],
+		Errors:        counters[STAT_ERRORS],
+		BytesServed:   counters[STAT_BYTES_SERVED],
+		BytesFilled:   counters[STAT_BYTES_FILLED],
+		Evictions:     counters[STAT_EVICTIONS],
+		Fills:         counters[STAT_FILLS],
+		FillLatency50: percentile(latency, 0.5).Milliseconds(),
+		FillLatency90: percentile(latency, 0.9).Milliseconds(),
+		FillLatency99: percentile(latency, 0.99).Milliseconds(),
+	}
+	if total := stat.Hits + stat.Misses + stat.Errors; total != 0 {
+		stat.HitRate = float32(stat.Hits) / float32(total)
+	}
+	return stat
+}
+
+// percentile returns the upper bound of the bin where the percentile falls,
+// the longest bound is returned for the last bin.
+func percentile(hist [LATENCY_BINS]uint32, p float64) time.Duration {
+	var total uint64
+	for _, v := range hist {
+		total += uint64(v)
+	}
+	if total == 0 {
+		return 0
+	}
+	rank := uint64(float64(total)*p + 0.5)
+	if rank < 1 {
+		rank = 1
+	}
+	var count uint64
+	for i, v := range hist {
+		count += uint64(v)
+		if count >= rank && i < len(LatencyBounds) {
+			return LatencyBounds[i]
+		}
+	}
+	return LatencyBounds[len(LatencyBounds)-1]
+}
+
+func (w *WindowStats) GetWindowStats() []WindowStat {
+	stats := make([]WindowStat, 0, len(StatWindows))
+	for _, window := range StatWindows {
+		stats = append(stats, w.Stat(window))
+	}
+	return stats
+}
+
+// Save persists the buckets of the latest day, so that statistics survive restarts
+func (w *WindowStats) Save() error {
+	from := time.Now().Add(-STAT_HISTORY_TIME).Unix() / int64(STAT_BUCKET_TIME/time.Second)
+	var list []statBucket
+	w.lock.Lock()
+	for _, b := range w.buckets {
+		if b.Stamp > from {
+			list = append(list, b)
+		}
+	}
+	w.lock.Unlock()
+	bytes, err := json.Marshal(list)
+	if err != nil {
+		return errors.Wrap(err, "save window stats error")
+	}
+	err = os.WriteFile(StatsPath, bytes, os.ModePerm)
+	return errors.Wrap(err, "save window stats error")
+}
+
+func (w *WindowStats) Load() error {
+	var list []statBucket
+	bytes, err := os.ReadFile(StatsPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return errors.Wrap(err, "load window stats error")
+	}
+	if err = json.Unmarshal(bytes, &list); err != nil {
+		return errors.Wrap(err, "load window stats error")
+	}
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	for _, b := range list {
+		i := b.Stamp % int64(len(w.buckets))
+		if b.Stamp > w.buckets[i].Stamp {
+			w.buckets[i] = b
+		}
+	}
+	return nil
+}
+
+func (s CacheStats) GetWindowStats() []WindowStat {
+	return windows.GetWindowStats()
+}
+
+// RecordServed records the bytes served to users
+func RecordServed(n uint64) {
+	EgressMeter.Add(n)
+	windows.Add(STAT_BYTES_SERVED, n)
+}
+
+func initWindowStats() {
+	if err := windows.Load(); err != nil {
+		logger.Uld.Sugar().Errorf("load window stats error:%v.\n", err)
+	}
+}
@@ -73,8 +73,16 @@ func (c *chainClient) GetStorageFromChain(target any, prefix, method string, arg
 	return nil
 }
 
-// Query file meta info
+// Query file meta info, the result is cached for a while
 func (c *chainClient) GetFileMetaInfo(fid string) (FileMetaInfo, error) {
+	return c.metaCache.Get(fid, c.queryFileMetaInfo)
+}
+
+func (c *chainClient) InvalidateFileMetaInfo(fid string) {
+	c.metaCache.Delete(fid)
+}
+
+func (c *chainClient) queryFileMetaInfo(fid string) (FileMetaInfo, error) {
 	var (
 		data FileMetaInfo
 		hash FileHash
@@ -39,6 +39,8 @@ type IChain interface {
 	GetIncomeAccount() string
 	// GetFileMetaInfo returns file metadata by specific fid
 	GetFileMetaInfo(fid string) (FileMetaInfo, error)
+	// InvalidateFileMetaInfo drops the cached metadata of the file
+	InvalidateFileMetaInfo(fid string)
 	//
 	GetBill(hash types.Hash, bid string) (Bill, error)
 	//
@@ -49,6 +51,10 @@ type IChain interface {
 	Update(ip, port string, price uint64) (string, error)
 	//
 	Logout() (string, error)
+	// GetDeletedFiles returns the hashes of files deleted in the specified block
+	GetDeletedFiles(hash types.Hash) ([]string, error)
+	// WatchDeletedFiles calls back with the files deleted in every finalized block
+	WatchDeletedFiles(callback func(fids []string, complete bool)) error
 }
 
 var cli IChain
@@ -65,6 +71,9 @@ type chainClient struct {
 	rpcAddr         string
 	IncomeAcc       string
 	timeForBlockOut time.Duration
+	metaCache       *MetaCache
+	// The last finalized block checked for deleted files, watching resumes after it
+	watchedBlock uint64
 }
 
 var TimeOut_WaitBlock = time.Duration(time.Second * 15)
@@ -129,6 +138,7 @@ func NewChainClient(rpcAddr, secret, incomeAcc string, t time.Duration) (IChain,
 	cli.timeForBlockOut = t
 	cli.rpcAddr = rpcAddr
 	cli.IncomeAcc = incomeAcc
+	cli.metaCache = NewMetaCache(META_CACHE_SIZE)
 	return cli, nil
 }
 
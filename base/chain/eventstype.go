@@ -40,10 +40,20 @@ type Pay struct {
 	Topics []types.Hash
 }
 
+type DeleteFile struct {
+	Phase    types.Phase
+	Operator types.AccountID
+	Owner    types.AccountID
+	FileHash FileHash
+	Topics   []types.Hash
+}
+
 type CacheEventRecords struct {
 	types.EventRecords
 	Cacher_Register []CacherRegister
 	Cacher_Update   []CacherRegister
 	Cacher_Logout   []CacherLogout
 	Cacher_Pay      []Pay
+
+	FileBank_DeleteFile []DeleteFile
 }
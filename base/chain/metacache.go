@@ -0,0 +1,156 @@
+/*
+   Copyright 2022 CESS (Cumulus Encrypted Storage System) authors
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+        http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package chain
+
+import (
+	"container/list"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// Maximum number of file meta info kept in memory
+	META_CACHE_SIZE = 4096
+	// Time to live of file meta info
+	META_POSITIVE_TTL = time.Minute * 10
+	// Time to live of the files not found on chain
+	META_NEGATIVE_TTL = time.Second * 30
+)
+
+// errQueryAborted is returned to the callers waiting for a query that panicked
+var errQueryAborted = errors.New("file meta query aborted")
+
+type metaEntry struct {
+	fid     string
+	meta    FileMetaInfo
+	err     error
+	expires time.Time
+}
+
+type metaCall struct {
+	wg   sync.WaitGroup
+	meta FileMetaInfo
+	err  error
+}
+
+// MetaCache is a bounded LRU cache of file meta info with TTL,
+// a negative entry is kept for the files not found on chain,
+// and concurrent queries of the same file are coalesced into one RPC.
+type MetaCache struct {
+	// Time to live of file meta info and of the files not found, they must be set before the cache is used
+	PositiveTTL time.Duration
+	NegativeTTL time.Duration
+
+	lock    sync.Mutex
+	size    int
+	entries map[string]*list.Element
+	lru     *list.List
+	calls   map[string]*metaCall
+}
+
+func NewMetaCache(size int) *MetaCache {
+	if size <= 0 {
+		size = META_CACHE_SIZE
+	}
+	return &MetaCache{
+		PositiveTTL: META_POSITIVE_TTL,
+		NegativeTTL: META_NEGATIVE_TTL,
+		size:        size,
+		entries:     make(map[string]*list.Element),
+		lru:         list.New(),
+		calls:       make(map[string]*metaCall),
+	}
+}
+
+func (m *MetaCache) load(fid string) (*metaEntry, bool) {
+	elem, ok := m.entries[fid]
+	if !ok {
+		return nil, false
+	}
+	entry := elem.Value.(*metaEntry)
+	if time.Since(entry.expires) >= 0 {
+		m.lru.Remove(elem)
+		delete(m.entries, fid)
+		return nil, false
+	}
+	m.lru.MoveToFront(elem)
+	return entry, true
+}
+
+func (m *MetaCache) store(fid string, meta FileMetaInfo, err error) {
+	ttl := m.PositiveTTL
+	if err != nil {
+		ttl = m.NegativeTTL
+	}
+	entry := &metaEntry{fid: fid, meta: meta, err: err, expires: time.Now().Add(ttl)}
+	if elem, ok := m.entries[fid]; ok {
+		elem.Value = entry
+		m.lru.MoveToFront(elem)
+		return
+	}
+	m.entries[fid] = m.lru.PushFront(entry)
+	for m.lru.Len() > m.size {
+		elem := m.lru.Back()
+		m.lru.Remove(elem)
+		delete(m.entries, elem.Value.(*metaEntry).fid)
+	}
+}
+
+// Get returns the cached file meta info, or calls query to load it,
+// only successful results and ERR_Empty errors are cached.
+func (m *MetaCache) Get(fid string, query func(fid string) (FileMetaInfo, error)) (FileMetaInfo, error) {
+	m.lock.Lock()
+	if entry, ok := m.load(fid); ok {
+		m.lock.Unlock()
+		return entry.meta, entry.err
+	}
+	if call, ok := m.calls[fid]; ok {
+		m.lock.Unlock()
+		call.wg.Wait()
+		return call.meta, call.err
+	}
+	call := &metaCall{err: errQueryAborted}
+	call.wg.Add(1)
+	m.calls[fid] = call
+	m.lock.Unlock()
+
+	//the waiters are released even if query panics, only completed results are cached
+	normal := false
+	defer func() {
+		m.lock.Lock()
+		delete(m.calls, fid)
+		if normal && (call.err == nil || IsEmpty(call.err)) {
+			m.store(fid, call.meta, call.err)
+		}
+		m.lock.Unlock()
+		call.wg.Done()
+	}()
+	call.meta, call.err = query(fid)
+	normal = true
+	return call.meta, call.err
+}
+
+func (m *MetaCache) Delete(fid string) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if elem, ok := m.entries[fid]; ok {
+		m.lru.Remove(elem)
+		delete(m.entries, fid)
+	}
+}
@@ -36,6 +36,7 @@ var (
 	ERR_RPC_TIMEOUT     = errors.New("timeout")
 	ERR_RPC_EMPTY_VALUE = errors.New("empty")
 	ERR_TX_FAILED       = errors.New("tx failed")
+	ERR_UNDECODABLE     = errors.New("undecodable events")
 )
 
 type FileHash [64]types.U8
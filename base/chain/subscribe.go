@@ -0,0 +1,101 @@
+/*
+   Copyright 2022 CESS (Cumulus Encrypted Storage System) authors
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+        http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package chain
+
+import (
+	"github.com/centrifuge/go-substrate-rpc-client/v4/types"
+	"github.com/pkg/errors"
+)
+
+// IsEmpty reports whether err is caused by querying a storage item that does not exist
+func IsEmpty(err error) bool {
+	return err != nil && errors.Cause(err).Error() == ERR_Empty
+}
+
+// GetDeletedFiles returns the hashes of files deleted in the specified block, ERR_UNDECODABLE is returned
+// with the deletions decoded if some events of the block can not be decoded, others may be missed then.
+func (c *chainClient) GetDeletedFiles(hash types.Hash) ([]string, error) {
+	var fids []string
+	events := CacheEventRecords{}
+	rawData, err := c.api.RPC.State.GetStorageRaw(c.keyEvents, hash)
+	if err != nil {
+		return fids, errors.Wrap(err, "get deleted files error")
+	}
+	//events not described in CacheEventRecords can not be decoded, decoding stops at the first of them
+	if err = types.EventRecordsRaw(*rawData).DecodeEventRecords(c.metadata, &events); err != nil {
+		err = errors.Wrapf(ERR_UNDECODABLE, "get deleted files error: %v", err)
+	}
+	for _, e := range events.FileBank_DeleteFile {
+		fid := make([]byte, len(e.FileHash))
+		for i := 0; i < len(e.FileHash); i++ {
+			fid[i] = byte(e.FileHash[i])
+		}
+		fids = append(fids, string(fid))
+	}
+	return fids, err
+}
+
+// WatchDeletedFiles follows finalized blocks and calls back with the files deleted in each of them,
+// blocks skipped by finality jumps are fetched one by one. complete is false if the events of the block
+// could not all be decoded, the caller must check the metadata of cached files then.
+// It blocks until the subscription fails, the next call resumes after the last block checked.
+func (c *chainClient) WatchDeletedFiles(callback func(fids []string, complete bool)) error {
+	if !c.IsChainClientOk() {
+		c.SetChainState(false)
+		return errors.Wrap(ERR_RPC_CONNECTION, "watch deleted files error")
+	}
+	c.SetChainState(true)
+	sub, err := c.api.RPC.Chain.SubscribeFinalizedHeads()
+	if err != nil {
+		return errors.Wrap(err, "watch deleted files error")
+	}
+	defer sub.Unsubscribe()
+	last := c.watchedBlock
+	for {
+		select {
+		case head, ok := <-sub.Chan():
+			if !ok {
+				return errors.Wrap(errors.New("subscription closed"), "watch deleted files error")
+			}
+			number := uint64(head.Number)
+			if last == 0 {
+				last = number - 1
+			}
+			for n := last + 1; n <= number; n++ {
+				hash, err := c.api.RPC.Chain.GetBlockHash(n)
+				if err != nil {
+					return errors.Wrap(err, "watch deleted files error")
+				}
+				fids, err := c.GetDeletedFiles(hash)
+				complete := err == nil
+				if err != nil && !errors.Is(err, ERR_UNDECODABLE) {
+					return errors.Wrap(err, "watch deleted files error")
+				}
+				for _, fid := range fids {
+					c.InvalidateFileMetaInfo(fid)
+				}
+				if len(fids) > 0 || !complete {
+					callback(fids, complete)
+				}
+				last = n
+				c.watchedBlock = n
+			}
+		case err = <-sub.Err():
+			return errors.Wrap(err, "watch deleted files error")
+		}
+	}
+}
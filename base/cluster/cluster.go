@@ -0,0 +1,112 @@
+package cluster
+
+import (
+	"cess-cacher/base/trans"
+	"cess-cacher/config"
+	"cess-cacher/utils"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// Requests of a slice are counted in the window to tell hot slices
+	HOT_WINDOW = time.Minute * 10
+	// Counters are pruned when there are more of them
+	HOT_MAX_KEYS = 100000
+)
+
+var (
+	ring *Ring
+	self [32]byte
+	// non-owners cache the slices requested as many times in HOT_WINDOW, 0 means never
+	hotThreshold int
+	hot          = &hotCounter{counts: make(map[string]*hotCount)}
+)
+
+// Init builds the ring of config ClusterNodes, entries are "<account>@<url>" and must include this cacher.
+// Cluster mode is disabled if no node is configured.
+func Init(conf config.Config) error {
+	if len(conf.ClusterNodes) == 0 {
+		return nil
+	}
+	pub, err := utils.DecodePublicKeyOfCessAccount(conf.AccountID)
+	if err != nil {
+		return errors.Wrap(err, "init cluster error")
+	}
+	copy(self[:], pub)
+	nodes := make([]trans.Peer, 0, len(conf.ClusterNodes))
+	var found bool
+	for _, entry := range conf.ClusterNodes {
+		node, err := trans.ParsePeer(entry)
+		if err != nil {
+			return errors.Wrap(err, "init cluster error")
+		}
+		if node.Pubkey == self {
+			found = true
+		}
+		nodes = append(nodes, node)
+	}
+	if !found {
+		return errors.New("init cluster error: this cacher is not in cluster nodes")
+	}
+	ring = NewRing(nodes, RING_VNODES)
+	hotThreshold = conf.ClusterHot
+	return nil
+}
+
+func Enabled() bool {
+	return ring != nil
+}
+
+// Owner returns the node owning the slice key, and whether it is this cacher
+func Owner(key string) (trans.Peer, bool) {
+	if ring == nil {
+		return trans.Peer{}, true
+	}
+	node := ring.Owner(key)
+	return node, node.Pubkey == self
+}
+
+// Hot records a request of the slice key, and reports whether it is hot enough to be cached by non-owners
+func Hot(key string) bool {
+	if hotThreshold <= 0 {
+		return false
+	}
+	return hot.add(key) >= hotThreshold
+}
+
+type hotCount struct {
+	count int
+	start time.Time
+}
+
+type hotCounter struct {
+	lock   sync.Mutex
+	counts map[string]*hotCount
+}
+
+func (h *hotCounter) add(key string) int {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	now := time.Now()
+	if len(h.counts) >= HOT_MAX_KEYS {
+		for k, c := range h.counts {
+			if now.Sub(c.start) > HOT_WINDOW {
+				delete(h.counts, k)
+			}
+		}
+		//too many slices are requested in the window, counting starts again
+		if len(h.counts) >= HOT_MAX_KEYS {
+			h.counts = make(map[string]*hotCount)
+		}
+	}
+	c, ok := h.counts[key]
+	if !ok || now.Sub(c.start) > HOT_WINDOW {
+		c = &hotCount{start: now}
+		h.counts[key] = c
+	}
+	c.count++
+	return c.count
+}
@@ -0,0 +1,85 @@
+package cluster
+
+import (
+	"bytes"
+	"cess-cacher/base/trans"
+	"crypto/sha256"
+	"encoding/binary"
+	"sort"
+)
+
+// Number of points of each node on the ring, more points spread slices more evenly
+const RING_VNODES = 160
+
+// Ring maps slice keys to nodes by consistent hashing,
+// so that a change of membership only moves the slices of the nodes changed.
+type Ring struct {
+	points []uint64
+	owners map[uint64]int
+	nodes  []trans.Peer
+}
+
+// NewRing places the nodes by their public keys, so that the ring depends neither on the order of config
+// nor on the address format of accounts, and a node configured twice is placed once.
+func NewRing(nodes []trans.Peer, vnodes int) *Ring {
+	nodes = append([]trans.Peer(nil), nodes...)
+	sort.Slice(nodes, func(i, j int) bool {
+		return bytes.Compare(nodes[i].Pubkey[:], nodes[j].Pubkey[:]) < 0
+	})
+	unique := nodes[:0]
+	for i, node := range nodes {
+		if i == 0 || node.Pubkey != nodes[i-1].Pubkey {
+			unique = append(unique, node)
+		}
+	}
+	nodes = unique
+	r := &Ring{
+		points: make([]uint64, 0, len(nodes)*vnodes),
+		owners: make(map[uint64]int, len(nodes)*vnodes),
+		nodes:  nodes,
+	}
+	for i, node := range nodes {
+		for v := 0; v < vnodes; v++ {
+			point := hashPoint(node.Pubkey, v)
+			//the earlier node keeps the point on collision, every node sees the same ring
+			if _, ok := r.owners[point]; ok {
+				continue
+			}
+			r.owners[point] = i
+			r.points = append(r.points, point)
+		}
+	}
+	sort.Slice(r.points, func(i, j int) bool {
+		return r.points[i] < r.points[j]
+	})
+	return r
+}
+
+// Owner returns the node of the first point clockwise from the key
+func (r *Ring) Owner(key string) trans.Peer {
+	if len(r.points) == 0 {
+		return trans.Peer{}
+	}
+	h := hashKey(key)
+	i := sort.Search(len(r.points), func(i int) bool {
+		return r.points[i] >= h
+	})
+	if i == len(r.points) {
+		i = 0
+	}
+	return r.nodes[r.owners[r.points[i]]]
+}
+
+// hashPoint returns the v-th point of the node with the public key
+func hashPoint(pub [32]byte, v int) uint64 {
+	var buf [36]byte
+	copy(buf[:], pub[:])
+	binary.BigEndian.PutUint32(buf[32:], uint32(v))
+	sum := sha256.Sum256(buf[:])
+	return binary.BigEndian.Uint64(sum[:8])
+}
+
+func hashKey(key string) uint64 {
+	sum := sha256.Sum256([]byte(key))
+	return binary.BigEndian.Uint64(sum[:8])
+}
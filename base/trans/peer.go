@@ -0,0 +1,214 @@
+package trans
+
+import (
+	"cess-cacher/base/trans/tcp"
+	"cess-cacher/config"
+	"cess-cacher/utils"
+	"context"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/CESSProject/go-keyring"
+	"github.com/pkg/errors"
+)
+
+const (
+	SOURCE_PEER = "peer"
+	// Headers of peer requests, the request is an encoded tcp.DownloadRequest bound to the peer account
+	PEER_HEADER_ACCOUNT = "Cess-Peer-Account"
+	PEER_HEADER_REQUEST = "Cess-Peer-Request"
+	PEER_HEADER_SIGN    = "Cess-Peer-Sign"
+	// The cluster node owning a slice starts to fill it if the header is set
+	PEER_HEADER_FILL = "Cess-Peer-Fill"
+	// Time limit of asking peers whether they cache a slice
+	PEER_QUERY_TIMEOUT = time.Second * 3
+)
+
+// Peer is another cacher of the same operator, it serves the slices in its cache to us
+type Peer struct {
+	Account string
+	Pubkey  [32]byte
+	URL     string
+}
+
+// peers are the configured peers and the other cluster nodes, both the peer source and the peer endpoint use them
+var peers []Peer
+
+// ErrPeerFilling means the peer does not cache the slice yet, but it has started to fill it
+var ErrPeerFilling = errors.New("slice is being cached by peer")
+
+// ParsePeer parses the entry "<account>@<url>" of config Peers and ClusterNodes
+func ParsePeer(entry string) (Peer, error) {
+	var peer Peer
+	acc, url, ok := strings.Cut(strings.TrimSpace(entry), "@")
+	if !ok || url == "" {
+		return peer, fmt.Errorf("bad peer %s", entry)
+	}
+	pub, err := utils.DecodePublicKeyOfCessAccount(acc)
+	if err != nil || len(pub) != 32 {
+		return peer, fmt.Errorf("bad peer account %s", acc)
+	}
+	peer.Account = acc
+	copy(peer.Pubkey[:], pub)
+	peer.URL = strings.TrimSuffix(url, "/")
+	return peer, nil
+}
+
+func initPeers(conf config.Config) error {
+	var self [32]byte
+	if len(conf.ClusterNodes) > 0 {
+		pub, err := utils.DecodePublicKeyOfCessAccount(conf.AccountID)
+		if err != nil {
+			return errors.Wrap(err, "init peers error")
+		}
+		copy(self[:], pub)
+	}
+	list := make([]Peer, 0, len(conf.Peers)+len(conf.ClusterNodes))
+	seen := make(map[[32]byte]struct{})
+	for _, entry := range append(append([]string{}, conf.Peers...), conf.ClusterNodes...) {
+		peer, err := ParsePeer(entry)
+		if err != nil {
+			return errors.Wrap(err, "init peers error")
+		}
+		//this cacher is one of the cluster nodes
+		if _, ok := seen[peer.Pubkey]; ok || peer.Pubkey == self {
+			continue
+		}
+		seen[peer.Pubkey] = struct{}{}
+		list = append(list, peer)
+	}
+	peers = list
+	return nil
+}
+
+// IsPeer reports whether the account is one of the configured peers
+func IsPeer(pub [32]byte) bool {
+	for _, peer := range peers {
+		if peer.Pubkey == pub {
+			return true
+		}
+	}
+	return false
+}
+
+// PeerSource fetches slices from the peers caching them, the peers are asked concurrently
+// and the slice is downloaded from the first one answering that it has the slice.
+type PeerSource struct {
+	Peers  []Peer
+	client *http.Client
+}
+
+func NewPeerSource(peers []Peer) PeerSource {
+	return PeerSource{Peers: peers, client: &http.Client{}}
+}
+
+// Fetch downloads the slice from a peer, the slice must have the size recorded on chain,
+// so that a broken peer does not spread bad slices over the cluster.
+func (p PeerSource) Fetch(ctx context.Context, fid, sid, dir string) error {
+	size, err := chainSliceSize(fid, sid)
+	if err != nil {
+		return err
+	}
+	peer, err := p.locate(ctx, fid, sid, size)
+	if err != nil {
+		return err
+	}
+	res, err := p.request(ctx, http.MethodGet, peer, fid, sid, false)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("peer %s response status %s", peer.URL, res.Status)
+	}
+	if res.ContentLength >= 0 && res.ContentLength != size {
+		return fmt.Errorf("peer %s slice size %d, %d on chain", peer.URL, res.ContentLength, size)
+	}
+	return saveSlice(res.Body, dir, sid, size)
+}
+
+// locate returns the first peer caching the slice of the size
+func (p PeerSource) locate(ctx context.Context, fid, sid string, size int64) (Peer, error) {
+	if len(p.Peers) == 0 {
+		return Peer{}, errors.New("no peer is configured")
+	}
+	ctx, cancel := context.WithTimeout(ctx, PEER_QUERY_TIMEOUT)
+	defer cancel()
+	found := make(chan Peer, len(p.Peers))
+	for _, peer := range p.Peers {
+		go func(peer Peer) {
+			res, err := p.request(ctx, http.MethodHead, peer, fid, sid, false)
+			if err != nil {
+				found <- Peer{}
+				return
+			}
+			res.Body.Close()
+			if res.StatusCode != http.StatusOK || res.ContentLength != size {
+				found <- Peer{}
+				return
+			}
+			found <- peer
+		}(peer)
+	}
+	for range p.Peers {
+		if peer := <-found; peer.URL != "" {
+			return peer, nil
+		}
+	}
+	return Peer{}, errors.New("slice is not cached by peers")
+}
+
+// OpenSlice opens the slice cached by peer, the peer starts to fill it if fill is true
+// and the slice is owned by the peer in cluster, ErrPeerFilling is returned then.
+func (p PeerSource) OpenSlice(ctx context.Context, peer Peer, fid, sid string, fill bool) (io.ReadCloser, int64, error) {
+	res, err := p.request(ctx, http.MethodGet, peer, fid, sid, fill)
+	if err != nil {
+		return nil, 0, err
+	}
+	switch res.StatusCode {
+	case http.StatusOK:
+		return res.Body, res.ContentLength, nil
+	case http.StatusAccepted:
+		res.Body.Close()
+		return nil, 0, ErrPeerFilling
+	default:
+		res.Body.Close()
+		return nil, 0, fmt.Errorf("peer %s response status %s", peer.URL, res.Status)
+	}
+}
+
+// request sends the request signed for the peer, so that it can neither be replayed nor sent to others
+func (p PeerSource) request(ctx context.Context, method string, peer Peer, fid, sid string, fill bool) (*http.Response, error) {
+	kr, err := keyring.FromURI(config.GetConfig().AccountSeed, keyring.NetSubstrate{})
+	if err != nil {
+		return nil, errors.Wrap(err, "peer request error")
+	}
+	dreq, err := tcp.NewDownloadRequest(fid, sid, peer.Pubkey)
+	if err != nil {
+		return nil, errors.Wrap(err, "peer request error")
+	}
+	msg, sign, err := dreq.Sign(kr)
+	if err != nil {
+		return nil, errors.Wrap(err, "peer request error")
+	}
+	req, err := http.NewRequestWithContext(ctx, method, fmt.Sprintf("%s/peer/slice/%s/%s", peer.URL, fid, sid), nil)
+	if err != nil {
+		return nil, errors.Wrap(err, "peer request error")
+	}
+	req.Header.Set(PEER_HEADER_ACCOUNT, config.GetConfig().AccountID)
+	req.Header.Set(PEER_HEADER_REQUEST, hex.EncodeToString(msg))
+	req.Header.Set(PEER_HEADER_SIGN, hex.EncodeToString(sign))
+	if fill {
+		req.Header.Set(PEER_HEADER_FILL, "1")
+	}
+	res, err := p.client.Do(req)
+	return res, errors.Wrap(err, "peer request error")
+}
+
+func (p PeerSource) String() string {
+	return SOURCE_PEER
+}
@@ -5,16 +5,22 @@ import (
 	"cess-cacher/base/trans/tcp"
 	"cess-cacher/config"
 	"cess-cacher/utils"
+	"context"
 	"fmt"
 	"net"
 	"os"
 	"path/filepath"
 
 	"github.com/CESSProject/go-keyring"
+	"github.com/centrifuge/go-substrate-rpc-client/v4/types"
 	"github.com/pkg/errors"
 )
 
-func DownloadFile(fid, filesDir, shash string) error {
+// pool keeps the sessions to miners for the next fills
+var pool = tcp.NewPool()
+
+// DownloadFile downloads the slice from the miner storing it, the download is aborted once ctx is done
+func DownloadFile(ctx context.Context, fid, filesDir, shash string) error {
 	// file meta info
 	fmeta, err := chain.GetChainCli().GetFileMetaInfo(fid)
 	if err != nil {
@@ -38,16 +44,18 @@ func DownloadFile(fid, filesDir, shash string) error {
 			fmeta.BlockInfo[i].MinerIp.Value[3],
 			fmeta.BlockInfo[i].MinerIp.Port,
 		)
-		err = downloadFromStorage(fname, int64(fmeta.BlockInfo[i].BlockSize), mip, filesDir)
+		err = downloadFromStorage(ctx, fid, fname, int64(fmeta.BlockInfo[i].BlockSize), mip, fmeta.BlockInfo[i].MinerAcc, filesDir)
 		if err != nil {
 			return errors.Wrap(err, "download file error")
 		}
+		return nil
 	}
-	return nil
+	//the next source is tried if the slice is unknown
+	return errors.New("download file error: slice not found in file meta")
 }
 
 // Download files from cess storage service
-func downloadFromStorage(fpath string, fsize int64, mip string, dir string) error {
+func downloadFromStorage(ctx context.Context, fid, fpath string, fsize int64, mip string, minerAcc types.AccountID, dir string) error {
 	fsta, err := os.Stat(fpath)
 	if err == nil {
 		if fsta.Size() == fsize {
@@ -57,28 +65,41 @@ func downloadFromStorage(fpath string, fsize int64, mip string, dir string) erro
 		}
 	}
 
-	msg := utils.GetRandomcode(16)
-
 	kr, _ := keyring.FromURI(config.GetConfig().AccountSeed, keyring.NetSubstrate{})
-	// sign message
-	sign, err := kr.Sign(kr.SigningContext([]byte(msg)))
-	if err != nil {
-		return err
-	}
-
-	tcpAddr, err := net.ResolveTCPAddr("tcp", mip)
-	if err != nil {
-		return err
+	// sign the request bound to the slice and the miner for each attempt, old miners verify it as an opaque message
+	signer := func() ([]byte, []byte, error) {
+		req, err := tcp.NewDownloadRequest(fid, filepath.Base(fpath), minerAcc)
+		if err != nil {
+			return nil, nil, err
+		}
+		return req.Sign(kr)
 	}
 
-	conTcp, err := net.DialTCP("tcp", nil, tcpAddr)
-	if err != nil {
-		return err
-	}
-	srv := tcp.NewClient(tcp.NewTcp(conTcp), dir, nil)
 	pubkey, err := utils.DecodePublicKeyOfCessAccount(config.GetConfig().AccountID)
 	if err != nil {
 		return err
 	}
-	return srv.RecvFile(filepath.Base(fpath), fsize, pubkey, []byte(msg), sign[:])
+	dial := func(ctx context.Context) (net.Conn, error) {
+		dialer := net.Dialer{Timeout: tcp.Tcp_Dial_Timeout}
+		conn, err := dialer.DialContext(ctx, "tcp", mip)
+		if err != nil {
+			return nil, err
+		}
+		//the miner must prove it owns the account storing the slice
+		if config.GetConfig().SecureTransport {
+			conn, err = tcp.SecureClient(ctx, conn, kr, minerAcc)
+			if err != nil {
+				return nil, errors.Wrap(err, "secure connection error")
+			}
+		}
+		return conn, nil
+	}
+	//sessions are authenticated against the miner account, so they are pooled by both
+	key := fmt.Sprintf("%s/%x", mip, minerAcc[:])
+	return pool.Fetch(ctx, key, dial, dir, filepath.Base(fpath), fsize, pubkey, signer)
+}
+
+// ClosePool closes the idle sessions to miners
+func ClosePool() {
+	pool.Close()
 }
@@ -0,0 +1,226 @@
+package trans
+
+import (
+	"cess-cacher/base/chain"
+	"cess-cacher/base/trans/tcp"
+	"cess-cacher/config"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	SOURCE_MINER   = "miner"
+	SOURCE_GATEWAY = "gateway"
+	SOURCE_DIR     = "dir"
+)
+
+// Source fetches the slices of cache fills
+type Source interface {
+	// Fetch stores the slice sid of file fid in dir, as a file named sid
+	Fetch(ctx context.Context, fid, sid, dir string) error
+	String() string
+}
+
+// sources are tried in order, the miners storing slices are used by default
+var sources = []Source{MinerSource{}}
+
+// InitSources parses the configured sources, entries are "peer", "miner", "gateway:<url>" or "dir:<path>".
+// The url of gateway may contain {fid} and {sid}, otherwise "/<fid>/<sid>" is appended to it.
+// Peers are asked before miners if no source is configured.
+func InitSources(conf config.Config) error {
+	if err := initPeers(conf); err != nil {
+		return err
+	}
+	if len(conf.Sources) == 0 {
+		if len(peers) > 0 {
+			sources = []Source{NewPeerSource(peers), MinerSource{}}
+		}
+		return nil
+	}
+	list := make([]Source, 0, len(conf.Sources))
+	for _, entry := range conf.Sources {
+		kind, arg, _ := strings.Cut(entry, ":")
+		switch strings.TrimSpace(kind) {
+		case SOURCE_PEER:
+			if len(peers) == 0 {
+				return fmt.Errorf("init sources error: no peer is configured")
+			}
+			list = append(list, NewPeerSource(peers))
+		case SOURCE_MINER:
+			list = append(list, MinerSource{})
+		case SOURCE_GATEWAY:
+			if arg == "" {
+				return fmt.Errorf("init sources error: gateway url is empty")
+			}
+			list = append(list, NewGatewaySource(arg))
+		case SOURCE_DIR:
+			if arg == "" {
+				return fmt.Errorf("init sources error: dir path is empty")
+			}
+			list = append(list, DirSource{Dir: arg})
+		default:
+			return fmt.Errorf("init sources error: unknown source %s", entry)
+		}
+	}
+	sources = list
+	return nil
+}
+
+// Fill fetches the slice from the sources in order until one succeeds, the slice fetched
+// must have the size recorded on chain, otherwise it is removed and the next source is tried.
+func Fill(ctx context.Context, fid, dir, sid string, size uint64) error {
+	var errs []string
+	for _, src := range sources {
+		err := src.Fetch(ctx, fid, sid, dir)
+		if err == nil {
+			if err = checkSliceSize(dir, sid, size); err == nil {
+				return nil
+			}
+		}
+		errs = append(errs, fmt.Sprintf("%s: %v", src, err))
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	return fmt.Errorf("fill slice error: %s", strings.Join(errs, "; "))
+}
+
+// MinerSource downloads slices from the storage miners over the tcp protocol
+type MinerSource struct{}
+
+func (MinerSource) Fetch(ctx context.Context, fid, sid, dir string) error {
+	return DownloadFile(ctx, fid, dir, sid)
+}
+
+func (MinerSource) String() string {
+	return SOURCE_MINER
+}
+
+// GatewaySource downloads slices from a CESS gateway over http
+type GatewaySource struct {
+	URL    string
+	client *http.Client
+}
+
+func NewGatewaySource(url string) GatewaySource {
+	return GatewaySource{URL: url, client: &http.Client{}}
+}
+
+func (g GatewaySource) Fetch(ctx context.Context, fid, sid, dir string) error {
+	url := g.URL
+	if strings.Contains(url, "{fid}") || strings.Contains(url, "{sid}") {
+		url = strings.NewReplacer("{fid}", fid, "{sid}", sid).Replace(url)
+	} else {
+		url = strings.TrimSuffix(url, "/") + "/" + fid + "/" + sid
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return errors.Wrap(err, "gateway request error")
+	}
+	res, err := g.client.Do(req)
+	if err != nil {
+		return errors.Wrap(err, "gateway request error")
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("gateway response status %s", res.Status)
+	}
+	return saveSlice(res.Body, dir, sid, res.ContentLength)
+}
+
+func (g GatewaySource) String() string {
+	return SOURCE_GATEWAY + ":" + g.URL
+}
+
+// DirSource copies slices from a local directory, it is mainly used in tests
+type DirSource struct {
+	Dir string
+}
+
+func (d DirSource) Fetch(ctx context.Context, fid, sid, dir string) error {
+	f, err := os.Open(filepath.Join(d.Dir, sid))
+	if err != nil {
+		return errors.Wrap(err, "open source slice error")
+	}
+	defer f.Close()
+	stat, err := f.Stat()
+	if err != nil {
+		return errors.Wrap(err, "open source slice error")
+	}
+	return saveSlice(f, dir, sid, stat.Size())
+}
+
+func (d DirSource) String() string {
+	return SOURCE_DIR + ":" + d.Dir
+}
+
+// chainSliceSize returns the size of slice recorded on chain
+func chainSliceSize(fid, sid string) (int64, error) {
+	fmeta, err := chain.GetChainCli().GetFileMetaInfo(fid)
+	if err != nil {
+		return 0, errors.Wrap(err, "get slice size error")
+	}
+	for _, block := range fmeta.BlockInfo {
+		if string(block.BlockId[:]) == sid {
+			return int64(block.BlockSize), nil
+		}
+	}
+	return 0, errors.New("get slice size error: slice not found in file meta")
+}
+
+// checkSliceSize removes the slice fetched if its size differs from size
+func checkSliceSize(dir, sid string, size uint64) error {
+	fpath := filepath.Join(dir, sid)
+	info, err := os.Stat(fpath)
+	if err != nil {
+		return errors.Wrap(err, "check slice size error")
+	}
+	if uint64(info.Size()) != size {
+		os.Remove(fpath)
+		return fmt.Errorf("check slice size error: got %d bytes, %d on chain", info.Size(), size)
+	}
+	return nil
+}
+
+// meteredReader adds the bytes read to the download rate, which estimates the time of fills
+type meteredReader struct {
+	r io.Reader
+}
+
+func (m meteredReader) Read(p []byte) (int, error) {
+	n, err := m.r.Read(p)
+	tcp.RecvMeter.Add(uint64(n))
+	return n, err
+}
+
+// saveSlice writes the slice to a temporary file renamed when it is complete,
+// so a failed fetch leaves nothing behind for the next source.
+func saveSlice(r io.Reader, dir, sid string, size int64) error {
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		return errors.Wrap(err, "save slice error")
+	}
+	tmp, err := os.CreateTemp(dir, sid+".*.tmp")
+	if err != nil {
+		return errors.Wrap(err, "save slice error")
+	}
+	defer os.Remove(tmp.Name())
+	n, err := io.Copy(tmp, meteredReader{r})
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return errors.Wrap(err, "save slice error")
+	}
+	if size >= 0 && n != size {
+		return fmt.Errorf("save slice error: received %d bytes of %d", n, size)
+	}
+	err = os.Rename(tmp.Name(), filepath.Join(dir, sid))
+	return errors.Wrap(err, "save slice error")
+}
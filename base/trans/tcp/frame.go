@@ -0,0 +1,138 @@
+package tcp
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"sync"
+)
+
+const (
+	// Version of the JSON framing with the c100 magic
+	Protocol_Version_JSON uint8 = 1
+	// Version of the binary framing with the c200 magic
+	Protocol_Version_Binary uint8 = 2
+	// Version of sessions, a miner answering the recv head with it serves several files over the connection
+	// concurrently and carries the file name requested in its file, end and notify messages
+	Protocol_Version_Session uint8 = 3
+	// The latest version supported
+	Protocol_Version = Protocol_Version_Session
+	// Size of the fixed header of binary frames, including the magic
+	TCP_FrameHeader = 34
+	// Size of file chunks sent in binary frames
+	TCP_FrameBuffer = 256 * 1024
+	// Max size of the payload of binary frames
+	TCP_MaxFramePayload = 4 * 1024 * 1024
+)
+
+var HEAD_FRAME = []byte("c200")
+
+var frameBufPool = &sync.Pool{
+	New: func() any {
+		return make([]byte, TCP_FrameBuffer)
+	},
+}
+
+// encodeFrame returns the header and variable fields of the binary frame of message,
+// the payload follows them on the wire.
+//
+//	magic[4] msgType[1] fileType[1] lastMark[1] version[1] fileSize[8]
+//	nameLen[2] hashLen[2] pubkeyLen[2] signmsgLen[2] signLen[2] checksumLen[2] digestLen[2] payloadLen[4]
+//	name hash pubkey signmsg sign checksum digest payload
+func encodeFrame(m *Message) ([]byte, error) {
+	fields := [][]byte{[]byte(m.FileName), []byte(m.FileHash), m.Pubkey, m.SignMsg, m.Sign, m.Checksum, m.Digest}
+	size := TCP_FrameHeader
+	for _, f := range fields {
+		if len(f) > 0xFFFF {
+			return nil, fmt.Errorf("frame field too long: %d", len(f))
+		}
+		size += len(f)
+	}
+	if len(m.Bytes) > TCP_MaxFramePayload {
+		return nil, fmt.Errorf("frame payload too long: %d", len(m.Bytes))
+	}
+	buf := make([]byte, TCP_FrameHeader, size)
+	copy(buf, HEAD_FRAME)
+	buf[4] = byte(m.MsgType)
+	buf[5] = m.FileType
+	if m.LastMark {
+		buf[6] = 1
+	}
+	buf[7] = m.Version
+	binary.BigEndian.PutUint64(buf[8:16], m.FileSize)
+	for i, f := range fields {
+		binary.BigEndian.PutUint16(buf[16+2*i:18+2*i], uint16(len(f)))
+	}
+	binary.BigEndian.PutUint32(buf[30:34], uint32(len(m.Bytes)))
+	for _, f := range fields {
+		buf = append(buf, f...)
+	}
+	return buf, nil
+}
+
+// decodeFrame reads a binary frame whose magic has been read
+func decodeFrame(r io.Reader) (*Message, error) {
+	header := make([]byte, TCP_FrameHeader-len(HEAD_FRAME))
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+	m := &Message{
+		MsgType:  MsgType(header[0]),
+		FileType: header[1],
+		LastMark: header[2] == 1,
+		Version:  header[3],
+		FileSize: binary.BigEndian.Uint64(header[4:12]),
+	}
+	var size int
+	lens := make([]int, 7)
+	for i := range lens {
+		lens[i] = int(binary.BigEndian.Uint16(header[12+2*i : 14+2*i]))
+		size += lens[i]
+	}
+	plen := int(binary.BigEndian.Uint32(header[26:30]))
+	if plen > TCP_MaxFramePayload {
+		return nil, fmt.Errorf("frame payload too long: %d", plen)
+	}
+	fields := make([]byte, size)
+	if _, err := io.ReadFull(r, fields); err != nil {
+		return nil, err
+	}
+	next := func(n int) []byte {
+		f := fields[:n:n]
+		fields = fields[n:]
+		if n == 0 {
+			return nil
+		}
+		return f
+	}
+	m.FileName = string(next(lens[0]))
+	m.FileHash = string(next(lens[1]))
+	m.Pubkey = next(lens[2])
+	m.SignMsg = next(lens[3])
+	m.Sign = next(lens[4])
+	m.Checksum = next(lens[5])
+	m.Digest = next(lens[6])
+	if plen <= TCP_FrameBuffer {
+		m.Bytes = frameBufPool.Get().([]byte)[:plen]
+	} else {
+		m.Bytes = make([]byte, plen)
+	}
+	if _, err := io.ReadFull(r, m.Bytes); err != nil {
+		releaseBuffer(m.Bytes)
+		return nil, err
+	}
+	return m, nil
+}
+
+// releaseBuffer puts the buffer of message back to the pool it comes from
+func releaseBuffer(buf []byte) {
+	switch cap(buf) {
+	case TCP_SendBuffer:
+		sendBufPool.Put(buf[:cap(buf)])
+	case TCP_ReadBuffer:
+		readBufPool.Put(buf[:cap(buf)])
+	case TCP_FrameBuffer:
+		frameBufPool.Put(buf[:cap(buf)])
+	default:
+	}
+}
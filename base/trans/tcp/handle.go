@@ -1,310 +1,591 @@
-package tcp
-
-import (
-	"errors"
-	"fmt"
-	"io"
-	"os"
-	"path/filepath"
-	"strings"
-	"time"
-)
-
-type Client interface {
-	SendFile(fid string, fsize int64, pkey, signmsg, sign []byte) error
-	RecvFile(fid string, fsize int64, pkey, signmsg, sign []byte) error
-}
-
-type NetConn interface {
-	HandlerLoop()
-	GetMsg() (*Message, bool)
-	SendMsg(m *Message)
-	Close() error
-	IsClose() bool
-}
-
-type ConMgr struct {
-	conn     NetConn
-	dir      string
-	fileName string
-
-	sendFiles []string
-
-	waitNotify chan bool
-	stop       chan struct{}
-}
-
-func (c *ConMgr) handler() error {
-	var (
-		err      error
-		recvFile *os.File
-	)
-
-	defer func() {
-		recover()
-		c.conn.Close()
-		close(c.waitNotify)
-		if recvFile != nil {
-			_ = recvFile.Close()
-		}
-	}()
-
-	for !c.conn.IsClose() {
-		m, ok := c.conn.GetMsg()
-		if !ok {
-			return fmt.Errorf("Getmsg failed")
-		}
-		if m == nil {
-			continue
-		}
-
-		switch m.MsgType {
-		case MsgHead:
-			switch cap(m.Bytes) {
-			case TCP_ReadBuffer:
-				readBufPool.Put(m.Bytes)
-			default:
-			}
-			c.conn.SendMsg(NewNotifyMsg(c.fileName, Status_Ok))
-		case MsgFile:
-			if recvFile == nil {
-				recvFile, err = os.OpenFile(filepath.Join(c.dir, m.FileName), os.O_RDWR|os.O_TRUNC, os.ModePerm)
-				if err != nil {
-					c.conn.SendMsg(NewNotifyMsg("", Status_Err))
-					time.Sleep(TCP_Message_Interval)
-					c.conn.SendMsg(NewCloseMsg("", Status_Err))
-					time.Sleep(TCP_Message_Interval)
-					return err
-				}
-			}
-			_, err = recvFile.Write(m.Bytes[:m.FileSize])
-			if err != nil {
-				c.conn.SendMsg(NewNotifyMsg("", Status_Err))
-				time.Sleep(TCP_Message_Interval)
-				c.conn.SendMsg(NewCloseMsg("", Status_Err))
-				time.Sleep(TCP_Message_Interval)
-				return err
-			}
-			switch cap(m.Bytes) {
-			case TCP_ReadBuffer:
-				readBufPool.Put(m.Bytes)
-			default:
-			}
-		case MsgEnd:
-			switch cap(m.Bytes) {
-			case TCP_ReadBuffer:
-				readBufPool.Put(m.Bytes)
-			default:
-			}
-			info, err := recvFile.Stat()
-			if err != nil {
-				c.conn.SendMsg(NewNotifyMsg("", Status_Err))
-				time.Sleep(TCP_Message_Interval)
-				c.conn.SendMsg(NewCloseMsg("", Status_Err))
-				time.Sleep(TCP_Message_Interval)
-				return err
-			}
-			if info.Size() != int64(m.FileSize) {
-				err = fmt.Errorf("file.size %v rece size %v \n", info.Size(), m.FileSize)
-				c.conn.SendMsg(NewNotifyMsg("", Status_Err))
-				time.Sleep(TCP_Message_Interval)
-				c.conn.SendMsg(NewCloseMsg("", Status_Err))
-				time.Sleep(TCP_Message_Interval)
-				return err
-			}
-			recvFile.Close()
-			recvFile = nil
-
-		case MsgNotify:
-			c.waitNotify <- m.Bytes[0] == byte(Status_Ok)
-			switch cap(m.Bytes) {
-			case TCP_ReadBuffer:
-				readBufPool.Put(m.Bytes)
-			default:
-			}
-
-		case MsgClose:
-			switch cap(m.Bytes) {
-			case TCP_ReadBuffer:
-				readBufPool.Put(m.Bytes)
-			default:
-			}
-			return errors.New("Close message")
-
-		default:
-			switch cap(m.Bytes) {
-			case TCP_ReadBuffer:
-				readBufPool.Put(m.Bytes)
-			default:
-			}
-			return errors.New("Invalid msgType")
-		}
-	}
-
-	return err
-}
-
-func NewClient(conn NetConn, dir string, files []string) Client {
-	return &ConMgr{
-		conn:       conn,
-		dir:        dir,
-		sendFiles:  files,
-		waitNotify: make(chan bool, 1),
-		stop:       make(chan struct{}),
-	}
-}
-
-func (c *ConMgr) SendFile(fid string, fsize int64, pkey, signmsg, sign []byte) error {
-	c.conn.HandlerLoop()
-	go func() {
-		_ = c.handler()
-	}()
-
-	err := c.sendFile(fid, fsize, pkey, signmsg, sign)
-	return err
-}
-
-func (c *ConMgr) RecvFile(fid string, fsize int64, pkey, signmsg, sign []byte) error {
-	c.conn.HandlerLoop()
-	go func() {
-		_ = c.handler()
-	}()
-	err := c.recvFile(fid, fsize, pkey, signmsg, sign)
-	return err
-}
-
-func (c *ConMgr) sendFile(fid string, fsize int64, pkey, signmsg, sign []byte) error {
-	defer func() {
-		c.conn.Close()
-	}()
-
-	var err error
-	var lastmatrk bool
-
-	for i := 0; i < len(c.sendFiles); i++ {
-		if (i + 1) == len(c.sendFiles) {
-			lastmatrk = true
-		}
-		err = c.sendSingleFile(filepath.Join(c.dir, c.sendFiles[i]), fid, fsize, lastmatrk, pkey, signmsg, sign)
-		if err != nil {
-			return err
-		}
-		if strings.Contains(c.sendFiles[i], ".") {
-			os.Remove(filepath.Join(c.dir, c.sendFiles[i]))
-		}
-	}
-
-	c.conn.SendMsg(NewCloseMsg(c.fileName, Status_Ok))
-	time.Sleep(time.Second * 3)
-	return err
-}
-
-func (c *ConMgr) recvFile(fid string, fsize int64, pkey, signmsg, sign []byte) error {
-	defer func() {
-		c.conn.Close()
-	}()
-
-	//log.Println("Ready to recvhead: ", fid)
-	c.conn.SendMsg(NewRecvHeadMsg(fid, pkey, signmsg, sign))
-	timerHead := time.NewTimer(time.Second * 5)
-	defer timerHead.Stop()
-	select {
-	case ok := <-c.waitNotify:
-		if !ok {
-			return fmt.Errorf("send err")
-		}
-	case <-timerHead.C:
-		return fmt.Errorf("wait server msg timeout")
-	}
-
-	_, err := os.Create(filepath.Join(c.dir, fid))
-	if err != nil {
-		c.conn.SendMsg(NewCloseMsg(fid, Status_Err))
-		return err
-	}
-	//log.Println("Ready to recvfile: ", fid)
-	c.conn.SendMsg(NewRecvFileMsg(fid))
-
-	waitTime := fsize / 1024 / 10
-	if waitTime < 5 {
-		waitTime = 5
-	}
-
-	timerFile := time.NewTimer(time.Second * time.Duration(waitTime))
-	defer timerFile.Stop()
-	select {
-	case ok := <-c.waitNotify:
-		if !ok {
-			return fmt.Errorf("send err")
-		}
-	case <-timerFile.C:
-		return fmt.Errorf("wait server msg timeout")
-	}
-	c.conn.SendMsg(NewCloseMsg(fid, Status_Ok))
-	time.NewTimer(time.Second * 3)
-	return nil
-}
-
-func (c *ConMgr) sendSingleFile(filePath string, fid string, fsize int64, lastmark bool, pkey, signmsg, sign []byte) error {
-	file, err := os.Open(filePath)
-	if err != nil {
-		fmt.Printf("open file err %v \n", err)
-		return err
-	}
-
-	defer func() {
-		if file != nil {
-			_ = file.Close()
-		}
-	}()
-	fileInfo, _ := file.Stat()
-
-	//log.Println("Ready to write file: ", filePath)
-	c.conn.SendMsg(NewHeadMsg(fileInfo.Name(), fid, lastmark, pkey, signmsg, sign))
-
-	timerHead := time.NewTimer(10 * time.Second)
-	defer timerHead.Stop()
-	select {
-	case ok := <-c.waitNotify:
-		if !ok {
-			return fmt.Errorf("send head msg err")
-		}
-	case <-timerHead.C:
-		return fmt.Errorf("wait server msg timeout")
-	}
-
-	readBuf := sendBufPool.Get().([]byte)
-	defer func() {
-		sendBufPool.Put(readBuf)
-	}()
-
-	for !c.conn.IsClose() {
-		n, err := file.Read(readBuf)
-		if err != nil && err != io.EOF {
-			return err
-		}
-		if n == 0 {
-			break
-		}
-		c.conn.SendMsg(NewFileMsg(c.fileName, n, readBuf[:n]))
-	}
-
-	c.conn.SendMsg(NewEndMsg(c.fileName, fid, uint64(fileInfo.Size()), uint64(fsize), lastmark))
-	waitTime := fileInfo.Size() / 1024 / 10
-	if waitTime < 10 {
-		waitTime = 10
-	}
-
-	timerFile := time.NewTimer(time.Second * time.Duration(waitTime))
-	defer timerFile.Stop()
-	select {
-	case ok := <-c.waitNotify:
-		if !ok {
-			return fmt.Errorf("send end msg err")
-		}
-	case <-timerFile.C:
-		return fmt.Errorf("wait server msg timeout")
-	}
-
-	return nil
-}
+package tcp
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Client transfers files over a connection, the transfer is aborted
+// and the connection is closed once ctx is done.
+type Client interface {
+	SendFile(ctx context.Context, fid string, fsize int64, pkey, signmsg, sign []byte) error
+	RecvFile(ctx context.Context, fid string, fsize int64, pkey, signmsg, sign []byte) error
+}
+
+type NetConn interface {
+	HandlerLoop()
+	GetMsg() (*Message, bool)
+	SendMsg(m *Message) error
+	EnableBinary()
+	IsBinary() bool
+	SetDeadline(t time.Time) error
+	Close() error
+	IsClose() bool
+}
+
+var (
+	ErrChecksumMismatch = errors.New("chunk checksum mismatch")
+	ErrDigestMismatch   = errors.New("file digest mismatch")
+	ErrChunkSize        = errors.New("chunk size exceeds the message")
+	ErrFileSize         = errors.New("file size mismatch")
+	ErrUnknownStream    = errors.New("message of unknown file")
+	// ErrSessionAborted means the transfer is aborted by the failure of another one over the same session
+	ErrSessionAborted = errors.New("session is aborted")
+)
+
+type ConMgr struct {
+	conn     NetConn
+	fileName string
+
+	// dir, streams and closed are guarded by lock
+	lock sync.Mutex
+	dir  string
+
+	sendFiles []string
+
+	// streams are the files being received by name, the files of a session are received concurrently
+	streams map[string]*stream
+	closed  bool
+	// the protocol version accepted by the peer in its notify
+	peerVersion atomic.Uint32
+
+	waitNotify chan bool
+	stop       chan struct{}
+	// the error that ends handler, it is set before waitNotify is closed
+	handlerErr error
+}
+
+// stream is a file being received, the state of file is only touched by handler
+type stream struct {
+	name   string
+	dir    string
+	file   *os.File
+	digest hash.Hash
+	// complete is set once the whole file is received and verified
+	complete bool
+	// acked, discard and ended are guarded by the lock of ConMgr
+	acked   bool
+	discard bool
+	ended   bool
+
+	notify chan bool
+	// done is closed with err when the connection ends before the stream
+	done chan struct{}
+	err  error
+}
+
+func (c *ConMgr) handler() (err error) {
+	var failed *stream
+
+	defer func() {
+		c.conn.Close()
+		c.handlerErr = err
+		close(c.waitNotify)
+		c.abort(failed, err)
+	}()
+
+	for !c.conn.IsClose() {
+		m, ok := c.conn.GetMsg()
+		if !ok {
+			return fmt.Errorf("Getmsg failed")
+		}
+		if m == nil {
+			continue
+		}
+
+		switch m.MsgType {
+		case MsgHead:
+			releaseBuffer(m.Bytes)
+			notify := NewNotifyMsg(c.fileName, Status_Ok)
+			if m.Version >= Protocol_Version_Binary {
+				//files are pushed one by one, sessions are not offered to the sender
+				notify.Version = Protocol_Version_Binary
+				c.conn.SendMsg(notify)
+				c.conn.EnableBinary()
+				continue
+			}
+			c.conn.SendMsg(notify)
+		case MsgFile:
+			s := c.stream(m.FileName)
+			if s == nil {
+				releaseBuffer(m.Bytes)
+				return ErrUnknownStream
+			}
+			if c.discarded(s, false) {
+				releaseBuffer(m.Bytes)
+				continue
+			}
+			if err = s.recvChunk(m); err != nil {
+				failed = s
+				c.removeFile(s)
+				c.conn.SendMsg(NewNotifyMsg(s.name, Status_Err))
+				c.conn.SendMsg(NewCloseMsg(s.name, Status_Err))
+				return err
+			}
+		case MsgEnd:
+			releaseBuffer(m.Bytes)
+			s := c.stream(m.FileName)
+			if s == nil {
+				return ErrUnknownStream
+			}
+			if c.discarded(s, true) {
+				s.closeFile()
+				continue
+			}
+			if err = s.recvEnd(m); err != nil {
+				failed = s
+				c.removeFile(s)
+				c.conn.SendMsg(NewNotifyMsg(s.name, Status_Err))
+				c.conn.SendMsg(NewCloseMsg(s.name, Status_Err))
+				return err
+			}
+
+		case MsgNotify:
+			ok := len(m.Bytes) > 0 && m.Bytes[0] == byte(Status_Ok)
+			releaseBuffer(m.Bytes)
+			//the peer accepts the binary framing or the sessions offered
+			if ok && m.Version >= Protocol_Version_Binary {
+				c.conn.EnableBinary()
+			}
+			if ok && m.Version > 0 {
+				c.peerVersion.Store(uint32(m.Version))
+			}
+			if s := c.stream(m.FileName); s != nil {
+				c.notifyStream(s, ok)
+				continue
+			}
+			//nobody waits for the notify after the transfer ends
+			select {
+			case c.waitNotify <- ok:
+			case <-c.stop:
+				return nil
+			default:
+			}
+
+		case MsgClose:
+			releaseBuffer(m.Bytes)
+			return errors.New("Close message")
+
+		default:
+			releaseBuffer(m.Bytes)
+			return errors.New("Invalid msgType")
+		}
+	}
+
+	return err
+}
+
+// Multiplexed reports whether the peer confirmed that it serves several files over the connection
+func (c *ConMgr) Multiplexed() bool {
+	return c.peerVersion.Load() >= uint32(Protocol_Version_Session)
+}
+
+// stream returns the stream the message belongs to. Old miners may not carry the file name in messages,
+// they serve one file per connection, so the only stream is used.
+func (c *ConMgr) stream(name string) *stream {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if s, ok := c.streams[name]; ok {
+		return s
+	}
+	if !c.Multiplexed() && len(c.streams) == 1 {
+		for _, s := range c.streams {
+			return s
+		}
+	}
+	return nil
+}
+
+func (c *ConMgr) openStream(dir, name string) (*stream, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.closed {
+		return nil, ErrRequestUnacked
+	}
+	if _, ok := c.streams[name]; ok {
+		return nil, fmt.Errorf("file %s is being received", name)
+	}
+	s := &stream{
+		name:   name,
+		dir:    dir,
+		notify: make(chan bool, 2),
+		done:   make(chan struct{}),
+	}
+	c.streams[name] = s
+	return s, nil
+}
+
+// closeStream removes the stream received, or leaves the stream abandoned by its receiver to handler,
+// which drops the rest of file and removes the stream when the peer ends it.
+// The partial file of the stream abandoned is removed at once, handler does not touch it any more.
+func (c *ConMgr) closeStream(s *stream, abandon bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if abandon && !s.ended {
+		if s.acked && !s.discard {
+			os.Remove(filepath.Join(s.dir, s.name))
+		}
+		s.discard = true
+		return
+	}
+	if c.streams[s.name] == s {
+		delete(c.streams, s.name)
+	}
+}
+
+// discarded reports whether the receiver abandoned the stream, end marks the file is ended by the peer
+func (c *ConMgr) discarded(s *stream, end bool) bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if s.discard && end {
+		s.ended = true
+	}
+	return s.discard
+}
+
+func (c *ConMgr) notifyStream(s *stream, ok bool) {
+	c.lock.Lock()
+	s.acked = true
+	if s.discard {
+		if s.ended {
+			delete(c.streams, s.name)
+		}
+		c.lock.Unlock()
+		return
+	}
+	c.lock.Unlock()
+	select {
+	case s.notify <- ok:
+	default:
+	}
+}
+
+// abort ends the streams left when handler exits, the failed one with the error of handler
+func (c *ConMgr) abort(failed *stream, err error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.closed = true
+	for name, s := range c.streams {
+		switch {
+		case s == failed:
+			s.err = err
+		case !s.acked:
+			s.err = ErrRequestUnacked
+		default:
+			s.err = fmt.Errorf("%w: %v", ErrSessionAborted, err)
+		}
+		s.closeFile()
+		if s.acked && !s.complete && !s.discard && s != failed {
+			os.Remove(filepath.Join(s.dir, s.name))
+		}
+		close(s.done)
+		delete(c.streams, name)
+	}
+}
+
+// removeFile deletes the partial file of stream, unless the receiver abandoned the stream and removed it
+func (c *ConMgr) removeFile(s *stream) {
+	s.closeFile()
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if !s.discard {
+		os.Remove(filepath.Join(s.dir, s.name))
+	}
+}
+
+// recvChunk writes the chunk to the file, the caller removes the file on error
+func (s *stream) recvChunk(m *Message) error {
+	defer releaseBuffer(m.Bytes)
+	if s.file == nil {
+		f, err := os.OpenFile(filepath.Join(s.dir, s.name), os.O_RDWR|os.O_TRUNC, os.ModePerm)
+		if err != nil {
+			return err
+		}
+		s.file, s.digest = f, sha256.New()
+	}
+	if m.FileSize > uint64(len(m.Bytes)) {
+		return ErrChunkSize
+	}
+	//a corrupted chunk aborts the transfer before it is written
+	if len(m.Checksum) > 0 && !bytes.Equal(m.Checksum, ChunkChecksum(m.Bytes[:m.FileSize])) {
+		return ErrChecksumMismatch
+	}
+	s.digest.Write(m.Bytes[:m.FileSize])
+	_, err := s.file.Write(m.Bytes[:m.FileSize])
+	RecvMeter.Add(m.FileSize)
+	return err
+}
+
+// recvEnd verifies the file received, the caller removes the file on error
+func (s *stream) recvEnd(m *Message) error {
+	if s.file == nil {
+		return errors.New("end of file not received")
+	}
+	info, err := s.file.Stat()
+	if err != nil {
+		return err
+	}
+	if info.Size() != int64(m.FileSize) {
+		return fmt.Errorf("%w: received %d bytes of %d", ErrFileSize, info.Size(), m.FileSize)
+	}
+	if len(m.Digest) > 0 && !bytes.Equal(m.Digest, s.digest.Sum(nil)) {
+		return ErrDigestMismatch
+	}
+	err = s.file.Close()
+	s.file = nil
+	if err != nil {
+		return err
+	}
+	s.complete = true
+	return nil
+}
+
+func (s *stream) closeFile() {
+	if s.file != nil {
+		s.file.Close()
+		s.file = nil
+	}
+}
+
+// wait waits for the notify of peer about the stream
+func (s *stream) wait(ctx context.Context, timeout time.Duration, errMsg string) error {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case ok := <-s.notify:
+		if !ok {
+			return errors.New(errMsg)
+		}
+		return nil
+	case <-s.done:
+		return s.err
+	case <-timer.C:
+		return fmt.Errorf("wait server msg timeout")
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (c *ConMgr) getDir() string {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.dir
+}
+
+func NewClient(conn NetConn, dir string, files []string) Client {
+	return &ConMgr{
+		conn:       conn,
+		dir:        dir,
+		sendFiles:  files,
+		streams:    make(map[string]*stream),
+		waitNotify: make(chan bool, 1),
+		stop:       make(chan struct{}),
+	}
+}
+
+func (c *ConMgr) SendFile(ctx context.Context, fid string, fsize int64, pkey, signmsg, sign []byte) error {
+	c.conn.HandlerLoop()
+	go func() {
+		_ = c.handler()
+	}()
+	defer c.watch(ctx)()
+	err := c.sendFile(ctx, fid, fsize, pkey, signmsg, sign)
+	return err
+}
+
+func (c *ConMgr) RecvFile(ctx context.Context, fid string, fsize int64, pkey, signmsg, sign []byte) error {
+	c.conn.HandlerLoop()
+	go func() {
+		_ = c.handler()
+	}()
+	defer c.watch(ctx)()
+	err := c.recvFile(ctx, fid, fsize, pkey, signmsg, sign)
+	return err
+}
+
+// watch propagates the deadline and cancellation of ctx to the connection,
+// the returned function must be called when the transfer ends.
+func (c *ConMgr) watch(ctx context.Context) func() {
+	if deadline, ok := ctx.Deadline(); ok {
+		c.conn.SetDeadline(deadline)
+	}
+	go func() {
+		select {
+		case <-ctx.Done():
+			c.conn.Close()
+		case <-c.stop:
+		}
+	}()
+	return func() {
+		close(c.stop)
+	}
+}
+
+// wait waits for the notify of peer
+func (c *ConMgr) wait(ctx context.Context, timeout time.Duration, errMsg string) error {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case ok, open := <-c.waitNotify:
+		if !open && c.handlerErr != nil {
+			return c.handlerErr
+		}
+		if !ok {
+			return errors.New(errMsg)
+		}
+		return nil
+	case <-timer.C:
+		return fmt.Errorf("wait server msg timeout")
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (c *ConMgr) sendFile(ctx context.Context, fid string, fsize int64, pkey, signmsg, sign []byte) error {
+	defer func() {
+		c.conn.Close()
+	}()
+
+	var err error
+	var lastmatrk bool
+
+	for i := 0; i < len(c.sendFiles); i++ {
+		if (i + 1) == len(c.sendFiles) {
+			lastmatrk = true
+		}
+		err = c.sendSingleFile(ctx, filepath.Join(c.getDir(), c.sendFiles[i]), fid, fsize, lastmatrk, pkey, signmsg, sign)
+		if err != nil {
+			return err
+		}
+		if strings.Contains(c.sendFiles[i], ".") {
+			os.Remove(filepath.Join(c.getDir(), c.sendFiles[i]))
+		}
+	}
+
+	//the close message is flushed before the connection is closed
+	c.conn.SendMsg(NewCloseMsg(c.fileName, Status_Ok))
+	return err
+}
+
+func (c *ConMgr) recvFile(ctx context.Context, fid string, fsize int64, pkey, signmsg, sign []byte) error {
+	defer func() {
+		c.conn.Close()
+	}()
+
+	if err := c.fetch(ctx, c.getDir(), fid, fsize, pkey, signmsg, sign); err != nil {
+		return err
+	}
+	c.conn.SendMsg(NewCloseMsg(fid, Status_Ok))
+	return nil
+}
+
+// fetch requests the file and waits until it is received into dir, the connection is left open.
+// The files of a session are fetched concurrently, each transfer is abandoned once its ctx is done.
+func (c *ConMgr) fetch(ctx context.Context, dir, fid string, fsize int64, pkey, signmsg, sign []byte) error {
+	s, err := c.openStream(dir, fid)
+	if err != nil {
+		return err
+	}
+	//log.Println("Ready to recvhead: ", fid)
+	head := NewRecvHeadMsg(fid, pkey, signmsg, sign)
+	head.Version = Protocol_Version
+	if err := c.conn.SendMsg(head); err != nil {
+		c.closeStream(s, false)
+		return ErrRequestUnacked
+	}
+	if err := s.wait(ctx, time.Second*5, "send err"); err != nil {
+		c.closeStream(s, true)
+		return err
+	}
+
+	f, err := os.Create(filepath.Join(dir, fid))
+	if err != nil {
+		c.closeStream(s, false)
+		c.conn.SendMsg(NewCloseMsg(fid, Status_Err))
+		return err
+	}
+	f.Close()
+	//log.Println("Ready to recvfile: ", fid)
+	c.conn.SendMsg(NewRecvFileMsg(fid))
+
+	waitTime := fsize / 1024 / 10
+	if waitTime < 5 {
+		waitTime = 5
+	}
+
+	err = s.wait(ctx, time.Second*time.Duration(waitTime), "send err")
+	c.closeStream(s, err != nil)
+	return err
+}
+
+func (c *ConMgr) sendSingleFile(ctx context.Context, filePath string, fid string, fsize int64, lastmark bool, pkey, signmsg, sign []byte) error {
+	file, err := os.Open(filePath)
+	if err != nil {
+		fmt.Printf("open file err %v \n", err)
+		return err
+	}
+
+	defer func() {
+		if file != nil {
+			_ = file.Close()
+		}
+	}()
+	fileInfo, _ := file.Stat()
+
+	//log.Println("Ready to write file: ", filePath)
+	head := NewHeadMsg(fileInfo.Name(), fid, lastmark, pkey, signmsg, sign)
+	head.Version = Protocol_Version
+	c.conn.SendMsg(head)
+
+	if err := c.wait(ctx, 10*time.Second, "send head msg err"); err != nil {
+		return err
+	}
+
+	var readBuf []byte
+	if c.conn.IsBinary() {
+		readBuf = frameBufPool.Get().([]byte)
+	} else {
+		readBuf = sendBufPool.Get().([]byte)
+	}
+	defer func() {
+		releaseBuffer(readBuf)
+	}()
+
+	digest := sha256.New()
+	for !c.conn.IsClose() && ctx.Err() == nil {
+		n, err := file.Read(readBuf)
+		if err != nil && err != io.EOF {
+			return err
+		}
+		if n == 0 {
+			break
+		}
+		m := NewFileMsg(c.fileName, n, readBuf[:n])
+		m.Checksum = ChunkChecksum(readBuf[:n])
+		digest.Write(readBuf[:n])
+		if err = c.conn.SendMsg(m); err != nil {
+			return err
+		}
+	}
+
+	end := NewEndMsg(c.fileName, fid, uint64(fileInfo.Size()), uint64(fsize), lastmark)
+	end.Digest = digest.Sum(nil)
+	c.conn.SendMsg(end)
+	waitTime := fileInfo.Size() / 1024 / 10
+	if waitTime < 10 {
+		waitTime = 10
+	}
+
+	return c.wait(ctx, time.Second*time.Duration(waitTime), "send end msg err")
+}
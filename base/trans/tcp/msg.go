@@ -1,170 +1,194 @@
-package tcp
-
-import (
-	"encoding/binary"
-	"sync"
-)
-
-type MsgType byte
-
-const (
-	MsgInvalid MsgType = iota
-	MsgHead
-	MsgFile
-	MsgEnd
-	MsgNotify
-	MsgClose
-	MsgRecvHead
-	MsgRecvFile
-)
-
-const (
-	FileType_file   uint8 = 1
-	FileType_filler uint8 = 2
-)
-
-type Status byte
-
-const (
-	Status_Ok Status = iota
-	Status_Err
-)
-
-type Message struct {
-	Pubkey   []byte  `json:"pubkey"`
-	SignMsg  []byte  `json:"signmsg"`
-	Sign     []byte  `json:"sign"`
-	Bytes    []byte  `json:"bytes"`
-	FileName string  `json:"filename"`
-	FileHash string  `json:"filehash"`
-	FileSize uint64  `json:"filesize"`
-	MsgType  MsgType `json:"msgtype"`
-	LastMark bool    `json:"lastmark"`
-	FileType uint8   `json:"filetype"`
-}
-
-type Notify struct {
-	Status byte
-}
-
-var (
-	sendBufPool = &sync.Pool{
-		New: func() interface{} {
-			return make([]byte, TCP_SendBuffer)
-		},
-	}
-
-	readBufPool = &sync.Pool{
-		New: func() any {
-			return make([]byte, TCP_ReadBuffer)
-		},
-	}
-)
-
-func NewNotifyMsg(fileName string, status Status) *Message {
-	m := &Message{}
-	m.MsgType = MsgNotify
-	m.Bytes = []byte{byte(status)}
-	m.FileName = fileName
-	m.FileHash = ""
-	m.FileSize = 0
-	m.LastMark = false
-	m.FileType = FileType_file
-	m.Pubkey = nil
-	m.SignMsg = nil
-	m.Sign = nil
-	return m
-}
-
-func NewHeadMsg(fileName string, fid string, lastmark bool, pkey, signmsg, sign []byte) *Message {
-	m := &Message{}
-	m.MsgType = MsgHead
-	m.FileName = fileName
-	m.FileHash = fid
-	m.FileSize = 0
-	m.LastMark = lastmark
-	m.FileType = FileType_file
-	m.Pubkey = pkey
-	m.SignMsg = signmsg
-	m.Sign = sign
-	m.Bytes = nil
-	return m
-}
-
-func NewRecvHeadMsg(fid string, pkey, signmsg, sign []byte) *Message {
-	m := &Message{}
-	m.MsgType = MsgRecvHead
-	m.FileName = fid
-	m.FileHash = fid
-	m.FileSize = 0
-	m.LastMark = false
-	m.FileType = FileType_file
-	m.Pubkey = pkey
-	m.SignMsg = signmsg
-	m.Sign = sign
-	m.Bytes = nil
-	return m
-}
-
-func NewRecvFileMsg(fid string) *Message {
-	m := &Message{}
-	m.MsgType = MsgRecvFile
-	m.FileName = fid
-	m.FileHash = ""
-	m.FileSize = 0
-	m.LastMark = false
-	m.FileType = FileType_file
-	m.Pubkey = nil
-	m.SignMsg = nil
-	m.Sign = nil
-	m.Bytes = nil
-	return m
-}
-
-func NewFileMsg(fileName string, buflen int, buf []byte) *Message {
-	m := &Message{}
-	m.MsgType = MsgFile
-	m.FileType = FileType_file
-	m.FileName = fileName
-	m.FileHash = ""
-	m.FileSize = uint64(buflen)
-	m.LastMark = false
-	m.Pubkey = nil
-	m.SignMsg = nil
-	m.Sign = nil
-	m.Bytes = sendBufPool.Get().([]byte)
-	copy(m.Bytes, buf)
-	return m
-}
-
-func NewEndMsg(fileName, fileHash string, size, originSize uint64, lastmark bool) *Message {
-	m := &Message{}
-	uintbytes := make([]byte, 8)
-	binary.BigEndian.PutUint64(uintbytes, originSize)
-	m.SignMsg = uintbytes
-	m.MsgType = MsgEnd
-	m.FileName = fileName
-	m.FileHash = fileHash
-	m.FileSize = size
-	m.FileType = FileType_file
-	m.LastMark = lastmark
-	m.Pubkey = nil
-	m.Sign = nil
-	m.Bytes = nil
-	return m
-}
-
-func NewCloseMsg(fileName string, status Status) *Message {
-	m := &Message{}
-	m.MsgType = MsgClose
-	m.Bytes = []byte{byte(status)}
-	m.FileName = fileName
-	m.FileHash = ""
-	m.FileSize = 0
-	m.FileType = FileType_file
-	m.LastMark = false
-	m.Pubkey = nil
-	m.SignMsg = nil
-	m.Sign = nil
-	return m
-}
+package tcp
+
+import (
+	"encoding/binary"
+	"hash/crc32"
+	"sync"
+)
+
+type MsgType byte
+
+const (
+	MsgInvalid MsgType = iota
+	MsgHead
+	MsgFile
+	MsgEnd
+	MsgNotify
+	MsgClose
+	MsgRecvHead
+	MsgRecvFile
+)
+
+const (
+	FileType_file   uint8 = 1
+	FileType_filler uint8 = 2
+)
+
+type Status byte
+
+const (
+	Status_Ok Status = iota
+	Status_Err
+)
+
+type Message struct {
+	Pubkey []byte `json:"pubkey"`
+	// SignMsg of MsgRecvHead is an encoded DownloadRequest, or a random code from old cachers
+	SignMsg  []byte  `json:"signmsg"`
+	Sign     []byte  `json:"sign"`
+	Bytes    []byte  `json:"bytes"`
+	FileName string  `json:"filename"`
+	FileHash string  `json:"filehash"`
+	FileSize uint64  `json:"filesize"`
+	MsgType  MsgType `json:"msgtype"`
+	LastMark bool    `json:"lastmark"`
+	FileType uint8   `json:"filetype"`
+	// Version offers or accepts a framing protocol, old peers ignore it
+	Version uint8 `json:"version,omitempty"`
+	// Checksum is the CRC-32C of the chunk in MsgFile, it is optional
+	Checksum []byte `json:"checksum,omitempty"`
+	// Digest is the SHA-256 of the whole file in MsgEnd, it is optional
+	Digest []byte `json:"digest,omitempty"`
+}
+
+var crc32cTable = crc32.MakeTable(crc32.Castagnoli)
+
+// ChunkChecksum returns the CRC-32C checksum carried by MsgFile
+func ChunkChecksum(chunk []byte) []byte {
+	sum := make([]byte, 4)
+	binary.BigEndian.PutUint32(sum, crc32.Checksum(chunk, crc32cTable))
+	return sum
+}
+
+type Notify struct {
+	Status byte
+}
+
+var (
+	sendBufPool = &sync.Pool{
+		New: func() interface{} {
+			return make([]byte, TCP_SendBuffer)
+		},
+	}
+
+	readBufPool = &sync.Pool{
+		New: func() any {
+			return make([]byte, TCP_ReadBuffer)
+		},
+	}
+)
+
+func NewNotifyMsg(fileName string, status Status) *Message {
+	m := &Message{}
+	m.MsgType = MsgNotify
+	m.Bytes = []byte{byte(status)}
+	m.FileName = fileName
+	m.FileHash = ""
+	m.FileSize = 0
+	m.LastMark = false
+	m.FileType = FileType_file
+	m.Pubkey = nil
+	m.SignMsg = nil
+	m.Sign = nil
+	return m
+}
+
+func NewHeadMsg(fileName string, fid string, lastmark bool, pkey, signmsg, sign []byte) *Message {
+	m := &Message{}
+	m.MsgType = MsgHead
+	m.FileName = fileName
+	m.FileHash = fid
+	m.FileSize = 0
+	m.LastMark = lastmark
+	m.FileType = FileType_file
+	m.Pubkey = pkey
+	m.SignMsg = signmsg
+	m.Sign = sign
+	m.Bytes = nil
+	return m
+}
+
+func NewRecvHeadMsg(fid string, pkey, signmsg, sign []byte) *Message {
+	m := &Message{}
+	m.MsgType = MsgRecvHead
+	m.FileName = fid
+	m.FileHash = fid
+	m.FileSize = 0
+	m.LastMark = false
+	m.FileType = FileType_file
+	m.Pubkey = pkey
+	m.SignMsg = signmsg
+	m.Sign = sign
+	m.Bytes = nil
+	return m
+}
+
+func NewRecvFileMsg(fid string) *Message {
+	m := &Message{}
+	m.MsgType = MsgRecvFile
+	m.FileName = fid
+	m.FileHash = ""
+	m.FileSize = 0
+	m.LastMark = false
+	m.FileType = FileType_file
+	m.Pubkey = nil
+	m.SignMsg = nil
+	m.Sign = nil
+	m.Bytes = nil
+	return m
+}
+
+func NewFileMsg(fileName string, buflen int, buf []byte) *Message {
+	m := &Message{}
+	m.MsgType = MsgFile
+	m.FileType = FileType_file
+	m.FileName = fileName
+	m.FileHash = ""
+	m.FileSize = uint64(buflen)
+	m.LastMark = false
+	m.Pubkey = nil
+	m.SignMsg = nil
+	m.Sign = nil
+	//chunks larger than the pooled buffers are not pooled
+	if buflen > TCP_FrameBuffer {
+		m.Bytes = make([]byte, buflen)
+	} else if buflen > TCP_SendBuffer {
+		m.Bytes = frameBufPool.Get().([]byte)[:buflen]
+	} else {
+		m.Bytes = sendBufPool.Get().([]byte)[:buflen]
+	}
+	copy(m.Bytes, buf)
+	return m
+}
+
+func NewEndMsg(fileName, fileHash string, size, originSize uint64, lastmark bool) *Message {
+	m := &Message{}
+	uintbytes := make([]byte, 8)
+	binary.BigEndian.PutUint64(uintbytes, originSize)
+	m.SignMsg = uintbytes
+	m.MsgType = MsgEnd
+	m.FileName = fileName
+	m.FileHash = fileHash
+	m.FileSize = size
+	m.FileType = FileType_file
+	m.LastMark = lastmark
+	m.Pubkey = nil
+	m.Sign = nil
+	m.Bytes = nil
+	return m
+}
+
+func NewCloseMsg(fileName string, status Status) *Message {
+	m := &Message{}
+	m.MsgType = MsgClose
+	m.Bytes = []byte{byte(status)}
+	m.FileName = fileName
+	m.FileHash = ""
+	m.FileSize = 0
+	m.FileType = FileType_file
+	m.LastMark = false
+	m.Pubkey = nil
+	m.SignMsg = nil
+	m.Sign = nil
+	return m
+}
@@ -0,0 +1,187 @@
+package tcp
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/CESSProject/go-keyring"
+	"github.com/pkg/errors"
+)
+
+const (
+	// Time limit between signing a download request and verifying it
+	Request_Max_Skew   = time.Minute * 2
+	Request_Nonce_Size = 16
+)
+
+// HEAD_REQUEST marks the SignMsg carrying an encoded DownloadRequest,
+// old miners verify the signature over SignMsg without decoding it.
+var HEAD_REQUEST = []byte("cdr1")
+
+var (
+	ErrInvalidRequest   = errors.New("invalid download request")
+	ErrRequestSignature = errors.New("invalid download request signature")
+	ErrRequestTarget    = errors.New("download request target mismatch")
+	ErrRequestExpired   = errors.New("download request expired")
+	ErrRequestReplayed  = errors.New("download request replayed")
+)
+
+// DownloadRequest is signed by the account downloading a slice, it binds the signature
+// to the slice, the miner storing it and the time, so it can not be replayed elsewhere.
+type DownloadRequest struct {
+	Fid       string
+	Sid       string
+	Miner     [32]byte
+	Timestamp int64
+	Nonce     []byte
+}
+
+func NewDownloadRequest(fid, sid string, miner [32]byte) (*DownloadRequest, error) {
+	nonce := make([]byte, Request_Nonce_Size)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, errors.Wrap(err, "generate request nonce error")
+	}
+	return &DownloadRequest{
+		Fid:       fid,
+		Sid:       sid,
+		Miner:     miner,
+		Timestamp: time.Now().Unix(),
+		Nonce:     nonce,
+	}, nil
+}
+
+// Encode returns the bytes signed and carried in the SignMsg of MsgRecvHead
+//
+//	magic[4] fidLen[2] fid sidLen[2] sid miner[32] timestamp[8] nonceLen[2] nonce
+func (r *DownloadRequest) Encode() []byte {
+	var buf bytes.Buffer
+	buf.Write(HEAD_REQUEST)
+	writeField(&buf, []byte(r.Fid))
+	writeField(&buf, []byte(r.Sid))
+	buf.Write(r.Miner[:])
+	binary.Write(&buf, binary.BigEndian, r.Timestamp)
+	writeField(&buf, r.Nonce)
+	return buf.Bytes()
+}
+
+func writeField(buf *bytes.Buffer, f []byte) {
+	binary.Write(buf, binary.BigEndian, uint16(len(f)))
+	buf.Write(f)
+}
+
+func readField(r io.Reader) ([]byte, error) {
+	var n uint16
+	if err := binary.Read(r, binary.BigEndian, &n); err != nil {
+		return nil, err
+	}
+	f := make([]byte, n)
+	_, err := io.ReadFull(r, f)
+	return f, err
+}
+
+// DecodeDownloadRequest decodes the SignMsg, it fails for the random codes signed by old cachers
+func DecodeDownloadRequest(msg []byte) (*DownloadRequest, error) {
+	if !bytes.HasPrefix(msg, HEAD_REQUEST) {
+		return nil, ErrInvalidRequest
+	}
+	var (
+		req DownloadRequest
+		r   = bytes.NewReader(msg[len(HEAD_REQUEST):])
+	)
+	fid, err := readField(r)
+	if err != nil {
+		return nil, ErrInvalidRequest
+	}
+	sid, err := readField(r)
+	if err != nil {
+		return nil, ErrInvalidRequest
+	}
+	if _, err = io.ReadFull(r, req.Miner[:]); err != nil {
+		return nil, ErrInvalidRequest
+	}
+	if err = binary.Read(r, binary.BigEndian, &req.Timestamp); err != nil {
+		return nil, ErrInvalidRequest
+	}
+	if req.Nonce, err = readField(r); err != nil || r.Len() != 0 {
+		return nil, ErrInvalidRequest
+	}
+	req.Fid, req.Sid = string(fid), string(sid)
+	return &req, nil
+}
+
+// Sign signs the request with the account key, the results fill the SignMsg and Sign of MsgRecvHead
+func (r *DownloadRequest) Sign(kr *keyring.KeyRing) ([]byte, []byte, error) {
+	msg := r.Encode()
+	sign, err := kr.Sign(kr.SigningContext(msg))
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "sign download request error")
+	}
+	return msg, sign[:], nil
+}
+
+// ReplayGuard remembers the nonces of requests until they expire
+type ReplayGuard struct {
+	lock   sync.Mutex
+	nonces map[string]int64
+}
+
+func NewReplayGuard() *ReplayGuard {
+	return &ReplayGuard{nonces: make(map[string]int64)}
+}
+
+// check returns false if the nonce has been seen, the expired nonces are dropped
+func (g *ReplayGuard) check(nonce []byte, expire int64) bool {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	now := time.Now().Unix()
+	for k, v := range g.nonces {
+		if v < now {
+			delete(g.nonces, k)
+		}
+	}
+	if _, ok := g.nonces[string(nonce)]; ok {
+		return false
+	}
+	g.nonces[string(nonce)] = expire
+	return true
+}
+
+// VerifyDownloadRequest verifies the request carried by MsgRecvHead is signed by Pubkey,
+// addressed to the account miner for the slice sid of file fid, and neither expired nor replayed.
+func VerifyDownloadRequest(m *Message, fid, sid string, miner [32]byte, guard *ReplayGuard) (*DownloadRequest, error) {
+	req, err := DecodeDownloadRequest(m.SignMsg)
+	if err != nil {
+		return nil, err
+	}
+	if len(m.Pubkey) != 32 || len(m.Sign) != 64 || len(req.Nonce) == 0 {
+		return nil, ErrInvalidRequest
+	}
+	var (
+		pub  [32]byte
+		sign [64]byte
+	)
+	copy(pub[:], m.Pubkey)
+	copy(sign[:], m.Sign)
+	kr, err := keyring.FromPublic(pub, keyring.NetSubstrate{})
+	if err != nil {
+		return nil, ErrInvalidRequest
+	}
+	if !kr.Verify(kr.SigningContext(m.SignMsg), sign) {
+		return nil, ErrRequestSignature
+	}
+	if req.Fid != fid || req.Sid != sid || req.Miner != miner {
+		return nil, ErrRequestTarget
+	}
+	skew := time.Since(time.Unix(req.Timestamp, 0))
+	if skew > Request_Max_Skew || skew < -Request_Max_Skew {
+		return nil, ErrRequestExpired
+	}
+	if guard != nil && !guard.check(req.Nonce, req.Timestamp+int64(Request_Max_Skew/time.Second)) {
+		return nil, ErrRequestReplayed
+	}
+	return req, nil
+}
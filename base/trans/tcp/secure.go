@@ -0,0 +1,168 @@
+package tcp
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io"
+	"math/big"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/CESSProject/go-keyring"
+	"github.com/pkg/errors"
+)
+
+const (
+	// Label of the keying material exported from the tls session, the identity proofs are bound to it
+	Secure_Binding_Label = "EXPORTER-cess-sr25519-binding"
+	Secure_Binding_Size  = 32
+	// Size of the identity proof, the account public key followed by its signature
+	Secure_Proof_Size = 32 + 64
+)
+
+var (
+	ErrPeerIdentity  = errors.New("peer identity mismatch")
+	ErrPeerSignature = errors.New("invalid peer identity signature")
+)
+
+var (
+	certOnce sync.Once
+	cert     tls.Certificate
+	certErr  error
+)
+
+// ephemeralCert returns a self-signed certificate generated once per process,
+// peers are authenticated by their account keys rather than by certificates.
+func ephemeralCert() (tls.Certificate, error) {
+	certOnce.Do(func() {
+		pub, priv, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			certErr = err
+			return
+		}
+		tmpl := &x509.Certificate{
+			SerialNumber: big.NewInt(time.Now().UnixNano()),
+			Subject:      pkix.Name{CommonName: "cess"},
+			NotBefore:    time.Now().Add(-time.Hour),
+			NotAfter:     time.Now().Add(time.Hour * 24 * 365),
+		}
+		der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, pub, priv)
+		if err != nil {
+			certErr = err
+			return
+		}
+		cert = tls.Certificate{Certificate: [][]byte{der}, PrivateKey: priv}
+	})
+	return cert, certErr
+}
+
+func secureConfig() (*tls.Config, error) {
+	c, err := ephemeralCert()
+	if err != nil {
+		return nil, errors.Wrap(err, "generate tls certificate error")
+	}
+	return &tls.Config{
+		Certificates:       []tls.Certificate{c},
+		MinVersion:         tls.VersionTLS13,
+		InsecureSkipVerify: true,
+		ClientAuth:         tls.RequireAnyClientCert,
+	}, nil
+}
+
+// SecureClient encrypts the connection with tls and verifies that the peer owns the account key peer,
+// the peer verifies the account key of kr in turn.
+func SecureClient(ctx context.Context, conn net.Conn, kr *keyring.KeyRing, peer [32]byte) (net.Conn, error) {
+	conf, err := secureConfig()
+	if err != nil {
+		return nil, err
+	}
+	tconn := tls.Client(conn, conf)
+	err = secureHandshake(ctx, tconn, kr, 'c', func(pub [32]byte) bool {
+		return pub == peer
+	})
+	if err != nil {
+		tconn.Close()
+		return nil, err
+	}
+	return tconn, nil
+}
+
+// secureHandshake runs the tls handshake, then the client and the server send the proof of their account key in turn.
+// The proof signs the keying material exported from the session together with the role,
+// so it can neither be replayed on another session nor reflected to its sender.
+func secureHandshake(ctx context.Context, conn *tls.Conn, kr *keyring.KeyRing, role byte, verify func(pub [32]byte) bool) error {
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+		defer conn.SetDeadline(time.Time{})
+	}
+	if err := conn.HandshakeContext(ctx); err != nil {
+		return errors.Wrap(err, "tls handshake error")
+	}
+	state := conn.ConnectionState()
+	binding, err := state.ExportKeyingMaterial(Secure_Binding_Label, nil, Secure_Binding_Size)
+	if err != nil {
+		return errors.Wrap(err, "export keying material error")
+	}
+	//the client proves its identity first, the server only answers an accepted client
+	if role == 'c' {
+		if err = sendProof(conn, kr, binding, 'c'); err != nil {
+			return err
+		}
+		return recvProof(conn, binding, 's', verify)
+	}
+	if err = recvProof(conn, binding, 'c', verify); err != nil {
+		return err
+	}
+	return sendProof(conn, kr, binding, 's')
+}
+
+func sendProof(conn net.Conn, kr *keyring.KeyRing, binding []byte, role byte) error {
+	sign, err := kr.Sign(kr.SigningContext(bindingMsg(binding, role)))
+	if err != nil {
+		return errors.Wrap(err, "sign identity proof error")
+	}
+	pub := kr.Public()
+	proof := make([]byte, 0, Secure_Proof_Size)
+	proof = append(proof, pub[:]...)
+	proof = append(proof, sign[:]...)
+	_, err = conn.Write(proof)
+	return errors.Wrap(err, "send identity proof error")
+}
+
+func recvProof(conn net.Conn, binding []byte, role byte, verify func(pub [32]byte) bool) error {
+	var (
+		pub  [32]byte
+		sign [64]byte
+	)
+	proof := make([]byte, Secure_Proof_Size)
+	if _, err := io.ReadFull(conn, proof); err != nil {
+		return errors.Wrap(err, "read identity proof error")
+	}
+	copy(pub[:], proof[:32])
+	copy(sign[:], proof[32:])
+	if verify != nil && !verify(pub) {
+		return ErrPeerIdentity
+	}
+	kr, err := keyring.FromPublic(pub, keyring.NetSubstrate{})
+	if err != nil {
+		return errors.Wrap(err, "decode peer public key error")
+	}
+	if !kr.Verify(kr.SigningContext(bindingMsg(binding, role)), sign) {
+		return ErrPeerSignature
+	}
+	return nil
+}
+
+func bindingMsg(binding []byte, role byte) []byte {
+	var buf bytes.Buffer
+	buf.WriteString(Secure_Binding_Label)
+	buf.Write(binding)
+	buf.WriteByte(role)
+	return buf.Bytes()
+}
@@ -0,0 +1,251 @@
+package tcp
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	// Number of sessions kept for each peer
+	Pool_Max_Sessions = 4
+	// Number of files received concurrently over a session
+	Session_Max_Streams = 8
+	// Idle sessions are closed after the time
+	Pool_Idle_Timeout = time.Minute
+)
+
+// ErrRequestUnacked means the connection was closed before the peer acknowledged the request,
+// an idle session closed by the peer fails this way and the request can be sent again.
+var ErrRequestUnacked = errors.New("request is not acknowledged before the connection is closed")
+
+// Signer signs the request of a fetch, it is called for each attempt so that the request
+// retried carries a new nonce and is not rejected as replayed by the miner
+type Signer func() (signmsg, sign []byte, err error)
+
+// Session keeps the connection to a miner open, files are received over it concurrently
+// if the miner confirms session support in the handshake of the first transfer.
+// The handler runs for the lifetime of the session, a failed transfer stops new ones
+// and the session is closed when the transfers left end.
+type Session struct {
+	mgr *ConMgr
+	key string
+
+	// active, broken and used are guarded by lock
+	lock   sync.Mutex
+	active int
+	broken bool
+	used   time.Time
+	once   sync.Once
+}
+
+// NewSession starts the session with one transfer reserved for the caller
+func NewSession(conn NetConn, key string) *Session {
+	s := &Session{
+		mgr: &ConMgr{
+			conn:       conn,
+			streams:    make(map[string]*stream),
+			waitNotify: make(chan bool, 1),
+			stop:       make(chan struct{}),
+		},
+		key:    key,
+		active: 1,
+		used:   time.Now(),
+	}
+	conn.HandlerLoop()
+	go func() {
+		_ = s.mgr.handler()
+	}()
+	return s
+}
+
+// RecvFile receives the file into dir, the transfer is abandoned if ctx is done before it ends.
+// A transfer must be reserved by NewSession or acquire, and is released by release.
+func (s *Session) RecvFile(ctx context.Context, dir, fid string, fsize int64, pkey, signmsg, sign []byte) error {
+	if !s.Alive() {
+		return ErrRequestUnacked
+	}
+	return s.mgr.fetch(ctx, dir, fid, fsize, pkey, signmsg, sign)
+}
+
+// Multiplexed reports whether the miner confirmed that it serves concurrent transfers over the session
+func (s *Session) Multiplexed() bool {
+	return s.mgr.Multiplexed()
+}
+
+func (s *Session) Alive() bool {
+	return !s.mgr.conn.IsClose()
+}
+
+// acquire reserves a transfer over the session, it fails if the session can not take one more
+func (s *Session) acquire() bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.broken || !s.Alive() || !s.Multiplexed() || s.active >= Session_Max_Streams {
+		return false
+	}
+	s.active++
+	return true
+}
+
+// release ends the transfer reserved, the session is closed if it is left idle and
+// either a transfer failed over it or it is not kept by the pool.
+func (s *Session) release(err error, kept bool) {
+	s.lock.Lock()
+	s.active--
+	s.used = time.Now()
+	if err != nil {
+		s.broken = true
+	}
+	closing := s.active == 0 && (s.broken || !kept)
+	s.lock.Unlock()
+	if closing {
+		s.Close()
+	}
+}
+
+// reusable reports whether the session takes new transfers, idle sessions expire after Pool_Idle_Timeout
+func (s *Session) reusable() bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.broken || !s.Alive() {
+		return false
+	}
+	return s.active > 0 || time.Since(s.used) < Pool_Idle_Timeout
+}
+
+// drain stops new transfers, the session is closed at once if it is idle
+func (s *Session) drain() {
+	s.lock.Lock()
+	s.broken = true
+	idle := s.active == 0
+	s.lock.Unlock()
+	if idle {
+		s.Close()
+	}
+}
+
+// Close tells the peer the session ends and closes the connection
+func (s *Session) Close() error {
+	s.once.Do(func() {
+		if s.Alive() {
+			s.mgr.conn.SendMsg(NewCloseMsg("", Status_Ok))
+		}
+		close(s.mgr.stop)
+	})
+	return s.mgr.conn.Close()
+}
+
+// Pool keeps the sessions by peer, so that fills from the same miner share the connection
+// and pay the handshake once. Only the sessions of miners confirming session support are kept,
+// the connections to other miners are closed after one transfer.
+type Pool struct {
+	lock     sync.Mutex
+	sessions map[string][]*Session
+	closed   bool
+}
+
+func NewPool() *Pool {
+	return &Pool{sessions: make(map[string][]*Session)}
+}
+
+// Fetch receives the file over a session of the peer identified by key,
+// a new session is opened with the connection returned by dial if none can take the transfer.
+func (p *Pool) Fetch(ctx context.Context, key string, dial func(context.Context) (net.Conn, error),
+	dir, fid string, fsize int64, pkey []byte, signer Signer) error {
+	for {
+		signmsg, sign, err := signer()
+		if err != nil {
+			return err
+		}
+		s, reused, err := p.get(ctx, key, dial)
+		if err != nil {
+			return err
+		}
+		err = s.RecvFile(ctx, dir, fid, fsize, pkey, signmsg, sign)
+		p.put(s, err)
+		if err == nil {
+			return nil
+		}
+		//the peer may close idle sessions at any time and a session is aborted by the failure
+		//of another transfer, the request is sent again on the next one
+		if !reused || !(errors.Is(err, ErrRequestUnacked) || errors.Is(err, ErrSessionAborted)) || ctx.Err() != nil {
+			return err
+		}
+	}
+}
+
+func (p *Pool) get(ctx context.Context, key string, dial func(context.Context) (net.Conn, error)) (*Session, bool, error) {
+	p.lock.Lock()
+	p.prune()
+	for _, s := range p.sessions[key] {
+		if s.acquire() {
+			p.lock.Unlock()
+			return s, true, nil
+		}
+	}
+	p.lock.Unlock()
+	conn, err := dial(ctx)
+	if err != nil {
+		return nil, false, err
+	}
+	return NewSession(NewTcp(conn), key), false, nil
+}
+
+// put releases the transfer, a new session is kept if the miner confirmed session support
+func (p *Pool) put(s *Session, err error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	kept := p.kept(s)
+	if !kept && err == nil && !p.closed && s.Multiplexed() && len(p.sessions[s.key]) < Pool_Max_Sessions {
+		p.sessions[s.key] = append(p.sessions[s.key], s)
+		kept = true
+	}
+	s.release(err, kept)
+	p.prune()
+}
+
+// kept reports whether the session is in the pool, the caller must hold the lock
+func (p *Pool) kept(s *Session) bool {
+	for _, ks := range p.sessions[s.key] {
+		if ks == s {
+			return true
+		}
+	}
+	return false
+}
+
+// prune drops the sessions closed by peers, broken or idle too long, the caller must hold the lock.
+// The sessions dropped in use are closed when their transfers are released.
+func (p *Pool) prune() {
+	for key, list := range p.sessions {
+		alive := list[:0]
+		for _, s := range list {
+			if s.reusable() {
+				alive = append(alive, s)
+				continue
+			}
+			s.drain()
+		}
+		if len(alive) == 0 {
+			delete(p.sessions, key)
+			continue
+		}
+		p.sessions[key] = alive
+	}
+}
+
+// Close closes the idle sessions, the sessions in use are closed when their transfers end
+func (p *Pool) Close() {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.closed = true
+	for _, list := range p.sessions {
+		for _, s := range list {
+			s.drain()
+		}
+	}
+	p.sessions = make(map[string][]*Session)
+}
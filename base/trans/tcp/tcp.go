@@ -1,188 +1,268 @@
-package tcp
-
-import (
-	"bytes"
-	"encoding/binary"
-	"encoding/json"
-	"fmt"
-	"io"
-	"net"
-	"sync"
-	"time"
-)
-
-const (
-	// Tcp message interval
-	TCP_Message_Interval = time.Duration(time.Millisecond * 10)
-	// Number of tcp message caches
-	TCP_Message_Send_Buffers = 10
-	TCP_Message_Read_Buffers = 10
-	//
-	TCP_SendBuffer = 8192
-	TCP_ReadBuffer = 12000
-	//
-	Tcp_Dial_Timeout = time.Duration(time.Second * 5)
-)
-
-type TcpCon struct {
-	conn *net.TCPConn
-
-	recv chan *Message
-	send chan *Message
-
-	onceStop *sync.Once
-	stop     chan struct{}
-}
-
-var (
-	HEAD_FILE   = []byte("c100")
-	HEAD_FILLER = []byte("c101")
-)
-
-func NewTcp(conn *net.TCPConn) *TcpCon {
-	return &TcpCon{
-		conn:     conn,
-		recv:     make(chan *Message, TCP_Message_Read_Buffers),
-		send:     make(chan *Message, TCP_Message_Send_Buffers),
-		onceStop: &sync.Once{},
-		stop:     make(chan struct{}),
-	}
-}
-
-func (t *TcpCon) HandlerLoop() {
-	go t.readMsg()
-	go t.sendMsg()
-}
-
-func (t *TcpCon) sendMsg() {
-	sendBuf := readBufPool.Get().([]byte)
-	defer func() {
-		recover()
-		t.Close()
-		time.Sleep(time.Second)
-		close(t.send)
-		readBufPool.Put(sendBuf)
-	}()
-	copy(sendBuf[:len(HEAD_FILE)], HEAD_FILE)
-	for !t.IsClose() {
-		select {
-		case m := <-t.send:
-			data, err := json.Marshal(m)
-			if err != nil {
-				return
-			}
-
-			switch cap(m.Bytes) {
-			case TCP_SendBuffer:
-				sendBufPool.Put(m.Bytes)
-			default:
-			}
-
-			binary.BigEndian.PutUint32(sendBuf[len(HEAD_FILE):len(HEAD_FILE)+4], uint32(len(data)))
-			copy(sendBuf[len(HEAD_FILE)+4:], data)
-
-			_, err = t.conn.Write(sendBuf[:len(HEAD_FILE)+4+len(data)])
-			if err != nil {
-				return
-			}
-		default:
-			time.Sleep(TCP_Message_Interval)
-		}
-	}
-}
-
-func (t *TcpCon) readMsg() {
-	var (
-		err    error
-		n      int
-		header = make([]byte, 4)
-	)
-	readBuf := readBufPool.Get().([]byte)
-	defer func() {
-		recover()
-		t.Close()
-		close(t.recv)
-		readBufPool.Put(readBuf)
-	}()
-	for {
-		// read until we get 4 bytes for the magic
-		_, err = io.ReadFull(t.conn, header)
-		if err != nil {
-			if err != io.EOF {
-				err = fmt.Errorf("initial read error: %v \n", err)
-				return
-			}
-			continue
-		}
-
-		if !bytes.Equal(header, HEAD_FILE) && !bytes.Equal(header, HEAD_FILLER) {
-			err = fmt.Errorf("initial bytes are not magic: %s", header)
-			return
-		}
-
-		// read until we get 4 bytes for the header
-		_, err = io.ReadAtLeast(t.conn, header, 4)
-		if err != nil {
-			if err != io.EOF {
-				return
-			}
-			continue
-		}
-
-		// data size
-		msgSize := binary.BigEndian.Uint32(header)
-
-		// read data
-		if msgSize > TCP_ReadBuffer {
-			return
-		}
-
-		n, err = io.ReadFull(t.conn, readBuf[:msgSize])
-		if err != nil {
-			return
-		}
-		m := &Message{}
-		m.Bytes = readBufPool.Get().([]byte)
-
-		err = json.Unmarshal(readBuf[:n], &m)
-		if err != nil {
-			return
-		}
-
-		t.recv <- m
-	}
-}
-
-func (t *TcpCon) GetMsg() (*Message, bool) {
-	timer := time.NewTimer(5 * time.Second)
-	defer timer.Stop()
-	select {
-	case m, ok := <-t.recv:
-		return m, ok
-	case <-timer.C:
-		return nil, true
-	}
-}
-
-func (t *TcpCon) SendMsg(m *Message) {
-	t.send <- m
-}
-
-func (t *TcpCon) Close() error {
-	t.onceStop.Do(func() {
-		t.conn.Close()
-		close(t.stop)
-	})
-	return nil
-}
-
-func (t *TcpCon) IsClose() bool {
-	select {
-	case <-t.stop:
-		return true
-	default:
-		return false
-	}
-}
-
-var _ = NetConn(&TcpCon{})
+package tcp
+
+import (
+	"bytes"
+	"cess-cacher/utils"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// Number of tcp message caches
+	TCP_Message_Send_Buffers = 10
+	TCP_Message_Read_Buffers = 10
+	//
+	TCP_SendBuffer = 8192
+	TCP_ReadBuffer = 12000
+	//
+	Tcp_Dial_Timeout = time.Duration(time.Second * 5)
+	// Time limit of flushing the queued messages when closing
+	Tcp_Flush_Timeout = time.Duration(time.Second * 3)
+)
+
+var ErrConnClosed = errors.New("connection is closed")
+
+// TcpCon sends and receives messages in two goroutines started by HandlerLoop.
+// SendMsg blocks while the send queue is full, so a slow peer slows down the sender.
+// Close stops both goroutines, the queued messages are flushed before the connection is closed.
+type TcpCon struct {
+	conn net.Conn
+
+	recv chan *Message
+	send chan *Message
+
+	// binary framing is used for sending once it is negotiated
+	binary atomic.Bool
+
+	onceStop  *sync.Once
+	onceStart *sync.Once
+	stop      chan struct{}
+	done      chan struct{}
+}
+
+var (
+	HEAD_FILE   = []byte("c100")
+	HEAD_FILLER = []byte("c101")
+)
+
+// RecvMeter measures the throughput of slices received from miners and the other fill sources
+var RecvMeter = utils.NewRateMeter(time.Minute)
+
+func NewTcp(conn net.Conn) *TcpCon {
+	return &TcpCon{
+		conn:      conn,
+		recv:      make(chan *Message, TCP_Message_Read_Buffers),
+		send:      make(chan *Message, TCP_Message_Send_Buffers),
+		onceStop:  &sync.Once{},
+		onceStart: &sync.Once{},
+		stop:      make(chan struct{}),
+		done:      make(chan struct{}),
+	}
+}
+
+func (t *TcpCon) HandlerLoop() {
+	t.onceStart.Do(func() {
+		go t.readMsg()
+		go t.sendMsg()
+	})
+}
+
+func (t *TcpCon) sendMsg() {
+	defer func() {
+		t.Close()
+		t.conn.Close()
+		close(t.done)
+	}()
+	for {
+		select {
+		case m := <-t.send:
+			if err := t.writeMsg(m); err != nil {
+				return
+			}
+		case <-t.stop:
+			t.flush()
+			return
+		}
+	}
+}
+
+// flush writes the messages queued before closing
+func (t *TcpCon) flush() {
+	t.conn.SetWriteDeadline(time.Now().Add(Tcp_Flush_Timeout))
+	for {
+		select {
+		case m := <-t.send:
+			if err := t.writeMsg(m); err != nil {
+				return
+			}
+		default:
+			return
+		}
+	}
+}
+
+func (t *TcpCon) writeMsg(m *Message) error {
+	defer releaseBuffer(m.Bytes)
+	var buffers net.Buffers
+	if t.binary.Load() {
+		header, err := encodeFrame(m)
+		if err != nil {
+			return err
+		}
+		buffers = net.Buffers{header, m.Bytes}
+	} else {
+		data, err := json.Marshal(m)
+		if err != nil {
+			return err
+		}
+		header := make([]byte, len(HEAD_FILE)+4)
+		copy(header, HEAD_FILE)
+		binary.BigEndian.PutUint32(header[len(HEAD_FILE):], uint32(len(data)))
+		buffers = net.Buffers{header, data}
+	}
+	_, err := buffers.WriteTo(t.conn)
+	return err
+}
+
+func (t *TcpCon) readMsg() {
+	var (
+		err    error
+		n      int
+		header = make([]byte, 4)
+	)
+	readBuf := readBufPool.Get().([]byte)
+	defer func() {
+		t.Close()
+		close(t.recv)
+		readBufPool.Put(readBuf)
+	}()
+	for {
+		// read until we get 4 bytes for the magic
+		if _, err = io.ReadFull(t.conn, header); err != nil {
+			return
+		}
+
+		//binary frames are accepted whether or not they are used for sending
+		if bytes.Equal(header, HEAD_FRAME) {
+			m, err := decodeFrame(t.conn)
+			if err != nil {
+				return
+			}
+			select {
+			case t.recv <- m:
+			case <-t.stop:
+				return
+			}
+			continue
+		}
+
+		if !bytes.Equal(header, HEAD_FILE) && !bytes.Equal(header, HEAD_FILLER) {
+			return
+		}
+
+		// read until we get 4 bytes for the header
+		if _, err = io.ReadFull(t.conn, header); err != nil {
+			return
+		}
+
+		// data size
+		msgSize := binary.BigEndian.Uint32(header)
+
+		// read data
+		if msgSize > TCP_ReadBuffer {
+			return
+		}
+
+		n, err = io.ReadFull(t.conn, readBuf[:msgSize])
+		if err != nil {
+			return
+		}
+		m := &Message{}
+		m.Bytes = readBufPool.Get().([]byte)
+
+		err = json.Unmarshal(readBuf[:n], &m)
+		if err != nil {
+			return
+		}
+
+		select {
+		case t.recv <- m:
+		case <-t.stop:
+			return
+		}
+	}
+}
+
+func (t *TcpCon) GetMsg() (*Message, bool) {
+	timer := time.NewTimer(5 * time.Second)
+	defer timer.Stop()
+	select {
+	case m, ok := <-t.recv:
+		return m, ok
+	case <-timer.C:
+		return nil, true
+	}
+}
+
+// SendMsg queues the message, it blocks while the queue is full and fails once the connection is closed
+func (t *TcpCon) SendMsg(m *Message) error {
+	select {
+	case <-t.stop:
+		return ErrConnClosed
+	default:
+	}
+	select {
+	case t.send <- m:
+		return nil
+	case <-t.stop:
+		return ErrConnClosed
+	}
+}
+
+// EnableBinary switches the sending to binary framing, it is called when the peer accepts it
+func (t *TcpCon) EnableBinary() {
+	t.binary.Store(true)
+}
+
+func (t *TcpCon) IsBinary() bool {
+	return t.binary.Load()
+}
+
+func (t *TcpCon) SetDeadline(deadline time.Time) error {
+	return t.conn.SetDeadline(deadline)
+}
+
+// Close stops the connection, the socket is closed after the queued messages are flushed
+func (t *TcpCon) Close() error {
+	t.onceStop.Do(func() {
+		close(t.stop)
+		//the loops are never started, so nothing is left to flush
+		t.onceStart.Do(func() {
+			t.conn.Close()
+			close(t.done)
+		})
+	})
+	return nil
+}
+
+// Done is closed when the connection is closed and its goroutines end
+func (t *TcpCon) Done() <-chan struct{} {
+	return t.done
+}
+
+func (t *TcpCon) IsClose() bool {
+	select {
+	case <-t.stop:
+		return true
+	default:
+		return false
+	}
+}
+
+var _ = NetConn(&TcpCon{})
@@ -22,6 +22,9 @@ func Execute() {
 		Command_UpdateCacherInfo(),
 		Command_LogoutCacher(),
 		Command_RunCacheServer(),
+		Command_MigrateCache(),
+		Command_RotateKey(),
+		Command_Cache(),
 	)
 	rootCmd.CompletionOptions.HiddenDefaultCmd = true
 	if err := rootCmd.Execute(); err != nil {
@@ -78,8 +81,67 @@ func Command_RunCacheServer() *cobra.Command {
 				logger.Uld.Sugar().Errorf("init cache error:%v", err)
 				log.Fatalf("init cache error:%v.\n", err)
 			}
+			go WaitForSignal()
 			server.SetupGinServer()
 		},
 		DisableFlagsInUseLine: true,
 	}
 }
+
+func Command_MigrateCache() *cobra.Command {
+	return &cobra.Command{
+		Use:   "migrate",
+		Short: "migrate cached files to the configured directory layout",
+		Run: func(cmd *cobra.Command, args []string) {
+			BuildConfig(cmd)
+			MigrateCache()
+			os.Exit(0)
+		},
+		DisableFlagsInUseLine: true,
+	}
+}
+
+func Command_RotateKey() *cobra.Command {
+	return &cobra.Command{
+		Use:   "rotate-key",
+		Short: "re-encrypt cached files with the current encryption key",
+		Run: func(cmd *cobra.Command, args []string) {
+			BuildConfig(cmd)
+			RotateKey()
+			os.Exit(0)
+		},
+		DisableFlagsInUseLine: true,
+	}
+}
+
+func Command_Cache() *cobra.Command {
+	cacheCmd := &cobra.Command{
+		Use:   "cache",
+		Short: "export or import cached files",
+	}
+	exportCmd := &cobra.Command{
+		Use:   "export",
+		Short: "export cached files and their index into an archive",
+		Run: func(cmd *cobra.Command, args []string) {
+			BuildConfig(cmd)
+			ExportCache(cmd)
+			os.Exit(0)
+		},
+	}
+	exportCmd.Flags().StringP("output", "o", "-", "archive file to write, - means stdout")
+	exportCmd.Flags().StringSlice("hash", nil, "only export the slices of these files")
+	exportCmd.Flags().Int("min-count", 0, "only export the slices used at least this many times")
+	exportCmd.Flags().Int("top", 0, "only export the hottest slices of this number")
+	importCmd := &cobra.Command{
+		Use:   "import",
+		Short: "import cached files and their index from an archive",
+		Run: func(cmd *cobra.Command, args []string) {
+			BuildConfig(cmd)
+			ImportCache(cmd)
+			os.Exit(0)
+		},
+	}
+	importCmd.Flags().StringP("input", "i", "-", "archive file to read, - means stdin")
+	cacheCmd.AddCommand(exportCmd, importCmd)
+	return cacheCmd
+}
@@ -1,10 +1,14 @@
 package cmd
 
 import (
+	"cess-cacher/base/cache"
 	"cess-cacher/base/chain"
 	"cess-cacher/config"
 	"cess-cacher/logger"
 	"log"
+	"os"
+	"os/signal"
+	"syscall"
 
 	"github.com/spf13/cobra"
 )
@@ -37,7 +41,64 @@ func LogoutCacher() {
 	log.Println("logout cacher success,tx hash is ", txhash)
 }
 
-func BuildProfile(cmd *cobra.Command) {
+func MigrateCache() {
+	count, err := cache.MigrateCacheLayout(config.GetConfig())
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Println("migrate cache success,migrated file directories:", count)
+}
+
+func RotateKey() {
+	count, err := cache.RotateCacheKeys(config.GetConfig())
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Println("rotate key success,re-encrypted files:", count)
+}
+
+func ExportCache(cmd *cobra.Command) {
+	var (
+		filter cache.ExportFilter
+		out    = os.Stdout
+	)
+	filter.Hashes, _ = cmd.Flags().GetStringSlice("hash")
+	filter.MinCount, _ = cmd.Flags().GetInt("min-count")
+	filter.Top, _ = cmd.Flags().GetInt("top")
+	if fpath, _ := cmd.Flags().GetString("output"); fpath != "-" {
+		f, err := os.Create(fpath)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer f.Close()
+		out = f
+	}
+	count, err := cache.ExportCache(config.GetConfig(), out, filter)
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Println("export cache success,exported files:", count)
+}
+
+func ImportCache(cmd *cobra.Command) {
+	in := os.Stdin
+	if fpath, _ := cmd.Flags().GetString("input"); fpath != "-" {
+		f, err := os.Open(fpath)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer f.Close()
+		in = f
+	}
+	count, err := cache.ImportCache(config.GetConfig(), in)
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Println("import cache success,imported files:", count)
+}
+
+// BuildConfig only loads the logger and config, for commands that do not need the chain
+func BuildConfig(cmd *cobra.Command) {
 	var configPath string
 	logger.InitLogger()
 	if path, _ := cmd.Flags().GetString("c"); path != "" {
@@ -49,6 +110,10 @@ func BuildProfile(cmd *cobra.Command) {
 		logger.Uld.Sugar().Errorf("init config error:%v", err)
 		log.Fatalf("init config error:%v.\n", err)
 	}
+}
+
+func BuildProfile(cmd *cobra.Command) {
+	BuildConfig(cmd)
 	if err := chain.InitChainClient(config.GetConfig()); err != nil {
 		logger.Uld.Sugar().Errorf("init chain client error:%v", err)
 		log.Fatalf("init chain client error:%v.\n", err)
@@ -60,3 +125,13 @@ func BuildProfile(cmd *cobra.Command) {
 		log.Fatalf("init test chain client error:%v.\n", err)
 	}
 }
+
+// WaitForSignal shuts down the cache when cacher is interrupted or terminated
+func WaitForSignal() {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGINT, syscall.SIGTERM)
+	sig := <-ch
+	logger.Uld.Sugar().Infof("received signal %v, shutting down.", sig)
+	cache.Shutdown()
+	os.Exit(0)
+}
@@ -2,23 +2,43 @@ package config
 
 import (
 	"os"
+	"time"
 
 	"github.com/pkg/errors"
 	"github.com/spf13/viper"
 )
 
 type Config struct {
-	CacheDir     string
-	MaxCacheSize uint64
-	MaxCacheRate float64
-	Threshold    float64
-	FreqWeight   float64
-	RpcAddr      string
-	ServerIp     string
-	ServerPort   string
-	AccountSeed  string
-	AccountID    string
-	BytePrice    uint64
+	CacheDir        string
+	MaxCacheSize    uint64
+	MaxCacheRate    float64
+	Threshold       float64
+	FreqWeight      float64
+	RpcAddr         string
+	ServerIp        string
+	ServerPort      string
+	AccountSeed     string
+	AccountID       string
+	BytePrice       uint64
+	EconomicMode    bool
+	FetchCost       uint64
+	DefaultTTL      time.Duration
+	FileTTL         map[string]time.Duration
+	DirLevels       int
+	DirWidth        int
+	Compress        bool
+	Encrypt         bool
+	Dedup           bool
+	KeyFile         string
+	OldKeyFiles     []string
+	WarmUp          bool
+	WarmUpTop       int
+	WarmUpRate      uint64
+	SecureTransport bool
+	Sources         []string
+	Peers           []string
+	ClusterNodes    []string
+	ClusterHot      int
 }
 
 var DefaultConfigPath = "./config/config.toml"
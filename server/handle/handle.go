@@ -1,11 +1,15 @@
 package handle
 
 import (
+	"cess-cacher/base/cache"
+	"cess-cacher/base/trans"
 	resp "cess-cacher/server/response"
 	"cess-cacher/server/service"
 	"cess-cacher/utils"
 	"fmt"
+	"io"
 	"log"
+	"net/http"
 	"path"
 	"strings"
 
@@ -19,7 +23,8 @@ func DownloadHandler(c *gin.Context) {
 		resp.RespError(c, resp.NewError(400, errors.New("bad token")))
 		return
 	}
-	res, se := service.DownloadService(tk.(service.Ticket))
+	t := tk.(service.Ticket)
+	res, body, se := service.DownloadService(c.Request.Context(), t)
 	if se != nil {
 		if se.Status() == 0 {
 			resp.RespOk(c, res)
@@ -28,14 +33,91 @@ func DownloadHandler(c *gin.Context) {
 		resp.RespError(c, se)
 		return
 	}
+	//the slice is proxied from its owner in cluster
+	if body != nil {
+		defer body.Close()
+		c.Writer.Header().Add("Content-Disposition", fmt.Sprintf("inline; filename=%v", t.SliceHash))
+		reader := &countReader{r: body}
+		c.DataFromReader(http.StatusOK, int64(t.Size), "application/octet-stream", reader, nil)
+		//the bill is booked only if the whole slice is streamed to the client
+		if reader.err == nil && reader.n == int64(t.Size) && c.Request.Context().Err() == nil {
+			service.RecordPaid(t)
+		}
+		return
+	}
 	_, fname := path.Split(res)
+	fname = cache.TrimSliceSuffix(fname)
 	if fname == "" {
 		fname = utils.GetRandomcode(64)
 	}
 	log.Println("filepath", res)
 	c.Writer.Header().Add("Content-Disposition", fmt.Sprintf("inline; filename=%v", fname))
+	serveSlice(c, res, int64(t.Size))
+	if c.Writer.Status() == http.StatusOK {
+		service.RecordPaid(t)
+	}
+}
+
+// countReader counts the bytes read, err keeps the first error other than io.EOF
+type countReader struct {
+	r   io.Reader
+	n   int64
+	err error
+}
+
+func (r *countReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	r.n += int64(n)
+	if err != nil && err != io.EOF && r.err == nil {
+		r.err = err
+	}
+	return n, err
+}
+
+// PeerHandler serves the slices cached here to peers, HEAD requests ask whether a slice is cached
+func PeerHandler(c *gin.Context) {
+	fill := c.GetHeader(trans.PEER_HEADER_FILL) == "1"
+	res, size, se := service.PeerSliceService(c.Param("fid"), c.Param("sid"), fill)
+	if se != nil {
+		resp.RespError(c, se)
+		return
+	}
+	if c.Request.Method == http.MethodHead {
+		c.Header("Content-Length", fmt.Sprint(size))
+		c.Status(http.StatusOK)
+		return
+	}
+	serveSlice(c, res, int64(size))
+}
+
+// serveSlice writes the original content of slice, which may be compressed or encrypted on disk
+func serveSlice(c *gin.Context, res string, size int64) {
 	c.Writer.Header().Add("Content-Type", "application/octet-stream")
-	c.File(res)
+	compressed, encrypted := cache.IsCompressed(res), cache.IsEncrypted(res)
+	if !compressed && !encrypted {
+		c.File(res)
+		return
+	}
+	//pass the compressed bytes through if the client accepts gzip encoding
+	passGzip := compressed && strings.Contains(c.GetHeader("Accept-Encoding"), "gzip")
+	if passGzip && !encrypted {
+		c.Writer.Header().Add("Content-Encoding", "gzip")
+		c.Writer.Header().Add("Vary", "Accept-Encoding")
+		c.File(res)
+		return
+	}
+	reader, err := cache.OpenSlice(res, !passGzip)
+	if err != nil {
+		resp.RespError(c, resp.NewError(500, err))
+		return
+	}
+	defer reader.Close()
+	if passGzip {
+		c.Writer.Header().Add("Content-Encoding", "gzip")
+		c.Writer.Header().Add("Vary", "Accept-Encoding")
+		size = -1
+	}
+	c.DataFromReader(http.StatusOK, size, "application/octet-stream", reader, nil)
 }
 
 func QueryHandler(c *gin.Context) {
@@ -60,6 +142,12 @@ func QueryHandler(c *gin.Context) {
 		resp.RespOkWithFlag(c, res.Size > 0, res)
 	case "price":
 		resp.RespOk(c, service.QueryBytePrice())
+	case "earnings":
+		resp.RespOk(c, service.QueryEarnings())
+	case "queue":
+		resp.RespOk(c, service.QueryFillQueue())
+	case "windows":
+		resp.RespOk(c, service.QueryWindowStats())
 	}
 }
 
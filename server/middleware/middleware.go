@@ -1,6 +1,8 @@
 package middleware
 
 import (
+	"cess-cacher/base/cache"
+	"cess-cacher/base/trans"
 	resp "cess-cacher/server/response"
 	"cess-cacher/server/service"
 	"cess-cacher/utils"
@@ -45,3 +47,47 @@ func Auth() gin.HandlerFunc {
 		c.Next()
 	}
 }
+
+// PeerAuth accepts the requests signed by configured peers for this cacher
+func PeerAuth() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		err := service.VerifyPeerRequest(
+			c.GetHeader(trans.PEER_HEADER_ACCOUNT),
+			c.GetHeader(trans.PEER_HEADER_REQUEST),
+			c.GetHeader(trans.PEER_HEADER_SIGN),
+			c.Param("fid"),
+			c.Param("sid"),
+		)
+		if err != nil {
+			resp.RespError(c, err)
+			c.Abort()
+			return
+		}
+		c.Next()
+	}
+}
+
+// meteredWriter counts the bytes written to the response
+type meteredWriter struct {
+	gin.ResponseWriter
+}
+
+func (w meteredWriter) Write(data []byte) (int, error) {
+	n, err := w.ResponseWriter.Write(data)
+	cache.RecordServed(uint64(n))
+	return n, err
+}
+
+func (w meteredWriter) WriteString(s string) (int, error) {
+	n, err := w.ResponseWriter.WriteString(s)
+	cache.RecordServed(uint64(n))
+	return n, err
+}
+
+// MeterEgress measures the throughput of the responses
+func MeterEgress() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Writer = meteredWriter{c.Writer}
+		c.Next()
+	}
+}
@@ -18,14 +18,22 @@ func NewRouter() *gin.Engine {
 		resp.RespError(c, resp.NewError(http.StatusInternalServerError, err.(error)))
 	}))
 	//download file group
-	dowmloadGroup := router.Group("/download").Use(middleware.Auth())
+	dowmloadGroup := router.Group("/download").Use(middleware.MeterEgress(), middleware.Auth())
 	dowmloadGroup.GET("/file/:token", handle.DownloadHandler)
 
+	//peer group, peers fill their caches from ours
+	peer := router.Group("/peer").Use(middleware.MeterEgress(), middleware.PeerAuth())
+	peer.HEAD("/slice/:fid/:sid", handle.PeerHandler)
+	peer.GET("/slice/:fid/:sid", handle.PeerHandler)
+
 	//query group
 	query := router.Group("/query")
 	query.GET("/stats", handle.QueryHandler)
 	query.GET("/cached", handle.QueryHandler)
 	query.GET("/file/:hash", handle.QueryHandler)
+	query.GET("/earnings", handle.QueryHandler)
+	query.GET("/queue", handle.QueryHandler)
+	query.GET("/windows", handle.QueryHandler)
 
 	//auth group
 	auth := router.Group("/auth")
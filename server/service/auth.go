@@ -50,8 +50,10 @@ func GenerateToken(hash, bid string, sign []byte) (string, resp.Error) {
 		return token, resp.NewError(400, errors.Wrap(err, "generate token error"))
 	}
 	token = base58.Encode(cipText)
-	//data preheating: prepare the files not downloaded
-	cache.GetCacheHandle().HitOrLoad(t.FileHash + "-" + t.SliceHash)
+	//data preheating: prepare the files not downloaded, slices owned by other nodes of cluster are proxied
+	if owned(t.FileHash + "-" + t.SliceHash) {
+		cache.GetCacheHandle().HitOrLoad(t.FileHash + "-" + t.SliceHash)
+	}
 	deleteTicket(bid)
 	return token, nil
 }
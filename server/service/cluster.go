@@ -0,0 +1,33 @@
+package service
+
+import (
+	"cess-cacher/base/cache"
+	"cess-cacher/base/cluster"
+	"cess-cacher/base/trans"
+)
+
+// clusterProxy opens the slices owned by other nodes of cluster
+var clusterProxy = trans.NewPeerSource(nil)
+
+// delegate returns the owner of slice if its download is proxied to the owner in cluster,
+// the slices cached here or hot enough are served here.
+func delegate(hash string) (trans.Peer, bool) {
+	if !cluster.Enabled() {
+		return trans.Peer{}, false
+	}
+	owner, self := cluster.Owner(hash)
+	if self {
+		return owner, false
+	}
+	hot := cluster.Hot(hash)
+	if res := cache.GetCacheHandle().FindHashs(hash); len(res) == 1 && res[0] == hash {
+		return owner, false
+	}
+	return owner, !hot
+}
+
+// owned reports whether the slice should be cached here without being requested
+func owned(hash string) bool {
+	_, self := cluster.Owner(hash)
+	return self
+}
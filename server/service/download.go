@@ -3,11 +3,13 @@ package service
 import (
 	"cess-cacher/base/cache"
 	"cess-cacher/base/chain"
+	"cess-cacher/base/trans"
 	"cess-cacher/config"
+	"cess-cacher/logger"
 	resp "cess-cacher/server/response"
+	"context"
 	"fmt"
-	"os"
-	"path"
+	"io"
 	"sync"
 	"time"
 
@@ -28,35 +30,80 @@ const TAB_FLASH_TIME = 3 * time.Hour
 
 var tickets *sync.Map
 
+// refusals are the bills whose downloads were refused by economic mode, the demand of a bill is counted once
+var refusals *sync.Map
+
 func InitTickets() {
 	if tickets == nil {
 		tickets = new(sync.Map)
 	}
+	if refusals == nil {
+		refusals = new(sync.Map)
+	}
 }
 
 func deleteTicket(key string) {
 	tickets.Delete(key)
 }
 
-func DownloadService(t Ticket) (string, resp.Error) {
+// RecordPaid books the bill of ticket as the revenue of its slice, once the slice is served
+func RecordPaid(t Ticket) {
+	cache.GetCacheHandle().RecordPaid(t.FileHash+"-"+t.SliceHash, t.Size*config.GetConfig().BytePrice)
+}
+
+// recordRefused books the bill of ticket as the demand of its slice, once for each bill
+func recordRefused(t Ticket) {
+	if _, ok := refusals.LoadOrStore(t.BID, t.Expires); ok {
+		return
+	}
+	cache.GetCacheHandle().RecordRefused(t.FileHash+"-"+t.SliceHash, t.Size*config.GetConfig().BytePrice)
+}
+
+// DownloadService returns the path of slice cached here, or the slice proxied from its owner in cluster
+func DownloadService(ctx context.Context, t Ticket) (string, io.ReadCloser, resp.Error) {
 	var slicePath string
 	if time.Since(t.Expires) >= 0 {
 		err := errors.New("The ticket has expired")
-		return slicePath, resp.NewError(400, errors.Wrap(err, "download service error"))
+		return slicePath, nil, resp.NewError(400, errors.Wrap(err, "download service error"))
 	}
 	if ticketBeUsed(t.BID, t.Expires) {
 		err := errors.New("The ticket has been used")
-		return slicePath, resp.NewError(400, errors.Wrap(err, "download service error"))
+		return slicePath, nil, resp.NewError(400, errors.Wrap(err, "download service error"))
+	}
+	if owner, ok := delegate(t.FileHash + "-" + t.SliceHash); ok {
+		body, size, err := clusterProxy.OpenSlice(ctx, owner, t.FileHash, t.SliceHash, true)
+		//a slice of other size than the one on chain is not proxied
+		if err == nil && size != int64(t.Size) {
+			body.Close()
+			err = fmt.Errorf("slice size %d, %d on chain", size, t.Size)
+		}
+		if err == nil {
+			return slicePath, body, nil
+		}
+		if errors.Is(err, trans.ErrPeerFilling) {
+			slicePath = fmt.Sprintf("file %s is being cached by cluster node, please try again later", t.SliceHash)
+			tickets.Delete(t.BID)
+			return slicePath, nil, resp.NewError(0, nil)
+		}
+		//the owner is unreachable, the slice is cached here instead
+		logger.Uld.Sugar().Errorf("proxy file %s from cluster node %s error:%v.\n", t.SliceHash, owner.URL, err)
 	}
 	if ok, err := cache.GetCacheHandle().HitOrLoad(t.FileHash + "-" + t.SliceHash); !ok {
+		//the demand refused by economic mode is booked for admission, the ticket can still be used elsewhere
+		if errors.Is(err, cache.ERR_NotProfitable) {
+			recordRefused(t)
+			tickets.Delete(t.BID)
+			err = fmt.Errorf("file %s is not cached: %w", t.SliceHash, err)
+			return slicePath, nil, resp.NewError(404, errors.Wrap(err, "download service error"))
+		}
 		if err != nil {
 			tickets.Delete(t.BID)
-			return slicePath, resp.NewError(500, errors.Wrap(err, "download service error"))
+			return slicePath, nil, resp.NewError(500, errors.Wrap(err, "download service error"))
 		}
 		if count, ok := cache.GetCacheHandle().LoadFailedFile(t.SliceHash); ok && count >= 1 {
 			err = errors.New("cache file failed,remote miner offline or refused")
 			tickets.Delete(t.BID)
-			return slicePath, resp.NewError(500, errors.Wrap(err, "download service error"))
+			return slicePath, nil, resp.NewError(500, errors.Wrap(err, "download service error"))
 		}
 		progress, ect := cache.DownloadProgressBar(t.FileHash, t.SliceHash, t.Size)
 		slicePath = fmt.Sprintf(
@@ -64,14 +111,14 @@ func DownloadService(t Ticket) (string, resp.Error) {
 			t.SliceHash, progress*100, ect,
 		)
 		tickets.Delete(t.BID)
-		return slicePath, resp.NewError(0, nil)
+		return slicePath, nil, resp.NewError(0, nil)
 	}
-	slicePath = path.Join(cache.FilesDir, t.FileHash, t.SliceHash)
-	if _, err := os.Stat(slicePath); err != nil {
+	slicePath, err := cache.LocateSlice(t.FileHash, t.SliceHash)
+	if err != nil {
 		tickets.Delete(t.BID)
-		return slicePath, resp.NewError(500, errors.Wrap(err, "download service error"))
+		return slicePath, nil, resp.NewError(500, errors.Wrap(err, "download service error"))
 	}
-	return slicePath, nil
+	return slicePath, nil, nil
 }
 
 func PraseTicketByBID(hash, bid string) (Ticket, error) {
@@ -129,5 +176,11 @@ func OrdersCleanServer() {
 			}
 			return true
 		})
+		refusals.Range(func(key, value any) bool {
+			if time.Since(value.(time.Time)) >= 0 {
+				refusals.Delete(key)
+			}
+			return true
+		})
 	}
 }
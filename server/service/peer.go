@@ -0,0 +1,76 @@
+package service
+
+import (
+	"cess-cacher/base/cache"
+	"cess-cacher/base/cluster"
+	"cess-cacher/base/trans"
+	"cess-cacher/base/trans/tcp"
+	"cess-cacher/config"
+	resp "cess-cacher/server/response"
+	"cess-cacher/utils"
+	"encoding/hex"
+	"net/http"
+
+	"github.com/pkg/errors"
+)
+
+var peerGuard = tcp.NewReplayGuard()
+
+// VerifyPeerRequest verifies the request is signed by a configured peer for the slice from this cacher
+func VerifyPeerRequest(account, request, sign, fid, sid string) resp.Error {
+	pub, err := utils.DecodePublicKeyOfCessAccount(account)
+	if err != nil || len(pub) != 32 {
+		err = errors.New("bad peer account")
+		return resp.NewError(http.StatusUnauthorized, errors.Wrap(err, "verify peer request error"))
+	}
+	var peer, self [32]byte
+	copy(peer[:], pub)
+	if !trans.IsPeer(peer) {
+		err = errors.New("unknown peer")
+		return resp.NewError(http.StatusForbidden, errors.Wrap(err, "verify peer request error"))
+	}
+	msg, err := hex.DecodeString(request)
+	if err != nil {
+		return resp.NewError(http.StatusUnauthorized, errors.Wrap(err, "verify peer request error"))
+	}
+	sig, err := hex.DecodeString(sign)
+	if err != nil {
+		return resp.NewError(http.StatusUnauthorized, errors.Wrap(err, "verify peer request error"))
+	}
+	pub, err = utils.DecodePublicKeyOfCessAccount(config.GetConfig().AccountID)
+	if err != nil {
+		return resp.NewError(http.StatusInternalServerError, errors.Wrap(err, "verify peer request error"))
+	}
+	copy(self[:], pub)
+	m := &tcp.Message{Pubkey: peer[:], SignMsg: msg, Sign: sig}
+	_, err = tcp.VerifyDownloadRequest(m, fid, sid, self, peerGuard)
+	if err != nil {
+		return resp.NewError(http.StatusUnauthorized, errors.Wrap(err, "verify peer request error"))
+	}
+	return nil
+}
+
+// PeerSliceService locates the slice requested by peer, slices not cached are not filled for peers,
+// unless fill is set and this cacher owns the slice in cluster.
+func PeerSliceService(fid, sid string, fill bool) (string, uint64, resp.Error) {
+	hash := fid + "-" + sid
+	if !cache.GetCacheHandle().Peek(hash) {
+		if _, self := cluster.Owner(hash); !fill || !cluster.Enabled() || !self {
+			err := errors.New("slice is not cached")
+			return "", 0, resp.NewError(http.StatusNotFound, errors.Wrap(err, "peer slice service error"))
+		}
+		ok, err := cache.GetCacheHandle().HitOrLoad(hash)
+		if err != nil {
+			return "", 0, resp.NewError(http.StatusInternalServerError, errors.Wrap(err, "peer slice service error"))
+		}
+		if !ok {
+			return "", 0, resp.NewError(http.StatusAccepted, trans.ErrPeerFilling)
+		}
+	}
+	info, _ := cache.GetCacheHandle().QueryFile(hash)
+	slicePath, err := cache.LocateSlice(fid, sid)
+	if err != nil {
+		return "", 0, resp.NewError(http.StatusNotFound, errors.Wrap(err, "peer slice service error"))
+	}
+	return slicePath, info.Size, nil
+}
@@ -10,20 +10,22 @@ import (
 )
 
 type MinerStats struct {
-	GeoLocation string            `json:"geoLocation"`
-	BytePrice   uint64            `json:"bytePrice"`
-	MinerStatus string            `json:"status"`
-	NetStats    cache.NetStats    `json:"netStats"`
-	MemoryStats cache.MemoryStats `json:"memStats"`
-	CPUStats    cache.CPUStats    `json:"cpuStats"`
-	DiskStats   cache.DiskStats   `json:"diskStats"`
-	CacheStat   cache.Stat        `json:"cacheStat"`
+	GeoLocation string             `json:"geoLocation"`
+	BytePrice   uint64             `json:"bytePrice"`
+	MinerStatus string             `json:"status"`
+	NetStats    cache.NetStats     `json:"netStats"`
+	MemoryStats cache.MemoryStats  `json:"memStats"`
+	CPUStats    cache.CPUStats     `json:"cpuStats"`
+	DiskStats   cache.DiskStats    `json:"diskStats"`
+	CacheStat   cache.Stat         `json:"cacheStat"`
+	WindowStats []cache.WindowStat `json:"windowStats"`
 }
 
 type FileStat struct {
-	Cached bool   `json:"cached"`
-	Price  uint64 `json:"price"`
-	Size   uint64 `json:"size"`
+	Cached   bool   `json:"cached"`
+	Price    uint64 `json:"price"`
+	Size     uint64 `json:"size"`
+	Earnings uint64 `json:"expectedEarnings"`
 }
 
 func QueryMinerStats() (MinerStats, resp.Error) {
@@ -34,6 +36,7 @@ func QueryMinerStats() (MinerStats, resp.Error) {
 	mstat.MinerStatus = "active"
 	mstat.NetStats = cache.GetNetInfo()
 	mstat.CacheStat = cache.GetCacheHandle().GetCacheStats()
+	mstat.WindowStats = cache.GetCacheHandle().GetWindowStats()
 	mstat.BytePrice = config.GetConfig().BytePrice
 	mstat.MemoryStats, err = cache.GetMemoryStats()
 	if err != nil {
@@ -70,9 +73,22 @@ func QueryFileInfo(hash string) FileStat {
 	stat.Cached = true
 	stat.Price = uint64(info.Size) * config.GetConfig().BytePrice
 	stat.Size = uint64(info.Size)
+	stat.Earnings = cache.GetCacheHandle().ExpectedEarnings(hash)
 	return stat
 }
 
+func QueryEarnings() cache.EarningsStat {
+	return cache.GetCacheHandle().GetEarningsStat()
+}
+
+func QueryWindowStats() []cache.WindowStat {
+	return cache.GetCacheHandle().GetWindowStats()
+}
+
+func QueryFillQueue() cache.FillQueueStat {
+	return cache.GetCacheHandle().GetFillQueue()
+}
+
 func QueryBytePrice() uint64 {
 	return config.GetConfig().BytePrice
 }
@@ -0,0 +1,80 @@
+package test
+
+import (
+	"bytes"
+	"cess-cacher/base/cache"
+	"cess-cacher/config"
+	"crypto/rand"
+	"io"
+	"testing"
+)
+
+// chunkLen is the size of an encrypted chunk, the plaintext chunk followed by the GCM tag
+const chunkLen = cache.ENC_CHUNK_SIZE + 16
+
+// encryptChunks encrypts random data of three and a half chunks with the key derived from a test seed
+func encryptChunks(t *testing.T) ([]byte, []byte) {
+	if err := cache.InitKeyRing(config.Config{AccountSeed: "encrypt test seed"}); err != nil {
+		t.Fatal("init key ring error", err)
+	}
+	plain := make([]byte, cache.ENC_CHUNK_SIZE*3+cache.ENC_CHUNK_SIZE/2)
+	rand.Read(plain)
+	var sealed bytes.Buffer
+	if err := cache.EncryptStream(&sealed, bytes.NewReader(plain), uint64(len(plain))); err != nil {
+		t.Fatal("encrypt stream error", err)
+	}
+	return plain, sealed.Bytes()
+}
+
+func decryptAll(sealed []byte) ([]byte, error) {
+	r, err := cache.NewDecryptReader(bytes.NewReader(sealed))
+	if err != nil {
+		return nil, err
+	}
+	return io.ReadAll(r)
+}
+
+func TestEncryptStreamRoundTrip(t *testing.T) {
+	plain, sealed := encryptChunks(t)
+	if want := cache.ENC_HEADER_LEN + 3*chunkLen + cache.ENC_CHUNK_SIZE/2 + 16; len(sealed) != want {
+		t.Fatalf("sealed size %d, want %d", len(sealed), want)
+	}
+	got, err := decryptAll(sealed)
+	if err != nil {
+		t.Fatal("decrypt error", err)
+	}
+	if !bytes.Equal(got, plain) {
+		t.Fatal("decrypted data differs from plaintext")
+	}
+}
+
+func TestEncryptStreamTampered(t *testing.T) {
+	_, sealed := encryptChunks(t)
+	sealed[cache.ENC_HEADER_LEN+chunkLen+100] ^= 0x01
+	if _, err := decryptAll(sealed); err == nil {
+		t.Fatal("tampered chunk is decrypted")
+	}
+}
+
+func TestEncryptStreamTruncated(t *testing.T) {
+	_, sealed := encryptChunks(t)
+	//drop the last chunk, the chunk before it was not sealed as the last one
+	if _, err := decryptAll(sealed[:cache.ENC_HEADER_LEN+3*chunkLen]); err == nil {
+		t.Fatal("truncated stream is decrypted")
+	}
+	if _, err := decryptAll(sealed[:len(sealed)-10]); err == nil {
+		t.Fatal("truncated chunk is decrypted")
+	}
+}
+
+func TestEncryptStreamReordered(t *testing.T) {
+	_, sealed := encryptChunks(t)
+	first := cache.ENC_HEADER_LEN
+	second := first + chunkLen
+	chunk := append([]byte{}, sealed[first:second]...)
+	copy(sealed[first:second], sealed[second:second+chunkLen])
+	copy(sealed[second:second+chunkLen], chunk)
+	if _, err := decryptAll(sealed); err == nil {
+		t.Fatal("reordered chunks are decrypted")
+	}
+}
@@ -0,0 +1,118 @@
+package test
+
+import (
+	"cess-cacher/base/chain"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// countingQuery returns a query answering err and counting its calls
+func countingQuery(calls *atomic.Int32, err error) func(string) (chain.FileMetaInfo, error) {
+	return func(fid string) (chain.FileMetaInfo, error) {
+		calls.Add(1)
+		if err != nil {
+			return chain.FileMetaInfo{}, err
+		}
+		return chain.FileMetaInfo{Size: 1024}, nil
+	}
+}
+
+func TestMetaCacheCoalesce(t *testing.T) {
+	mc := chain.NewMetaCache(16)
+	var calls atomic.Int32
+	release := make(chan struct{})
+	query := func(fid string) (chain.FileMetaInfo, error) {
+		calls.Add(1)
+		<-release
+		return chain.FileMetaInfo{Size: 1024}, nil
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			meta, err := mc.Get("fid", query)
+			if err != nil || meta.Size != 1024 {
+				t.Error("get meta error", meta, err)
+			}
+		}()
+	}
+	//the misses wait for the query in flight
+	time.Sleep(time.Millisecond * 50)
+	close(release)
+	wg.Wait()
+	if n := calls.Load(); n != 1 {
+		t.Fatalf("concurrent misses make %d queries, want 1", n)
+	}
+}
+
+func TestMetaCacheNegative(t *testing.T) {
+	mc := chain.NewMetaCache(16)
+	mc.NegativeTTL = time.Millisecond * 50
+	var calls atomic.Int32
+	query := countingQuery(&calls, chain.ERR_RPC_EMPTY_VALUE)
+	for i := 0; i < 2; i++ {
+		if _, err := mc.Get("fid", query); !chain.IsEmpty(err) {
+			t.Fatal("got error", err)
+		}
+	}
+	if n := calls.Load(); n != 1 {
+		t.Fatalf("file not found is queried %d times, want 1", n)
+	}
+	time.Sleep(mc.NegativeTTL)
+	mc.Get("fid", query)
+	if n := calls.Load(); n != 2 {
+		t.Fatalf("file not found is queried %d times after the negative TTL, want 2", n)
+	}
+
+	//other errors are not cached
+	calls.Store(0)
+	query = countingQuery(&calls, errors.New("rpc error"))
+	mc.Get("other", query)
+	mc.Get("other", query)
+	if n := calls.Load(); n != 2 {
+		t.Fatalf("failed query is made %d times, want 2", n)
+	}
+}
+
+func TestMetaCacheExpire(t *testing.T) {
+	mc := chain.NewMetaCache(16)
+	mc.PositiveTTL = time.Millisecond * 50
+	var calls atomic.Int32
+	query := countingQuery(&calls, nil)
+	mc.Get("fid", query)
+	mc.Get("fid", query)
+	if n := calls.Load(); n != 1 {
+		t.Fatalf("file is queried %d times, want 1", n)
+	}
+	time.Sleep(mc.PositiveTTL)
+	mc.Get("fid", query)
+	if n := calls.Load(); n != 2 {
+		t.Fatalf("file is queried %d times after the TTL, want 2", n)
+	}
+}
+
+func TestMetaCacheEvict(t *testing.T) {
+	mc := chain.NewMetaCache(2)
+	var calls atomic.Int32
+	query := countingQuery(&calls, nil)
+	//a is used again before c is loaded, so b is the least recently used
+	for _, fid := range []string{"a", "b", "a", "c"} {
+		mc.Get(fid, query)
+	}
+	if n := calls.Load(); n != 3 {
+		t.Fatalf("files are queried %d times, want 3", n)
+	}
+	mc.Get("a", query)
+	mc.Get("c", query)
+	if n := calls.Load(); n != 3 {
+		t.Fatalf("recently used file is evicted, %d queries", n)
+	}
+	mc.Get("b", query)
+	if n := calls.Load(); n != 4 {
+		t.Fatalf("least recently used file is not evicted, %d queries", n)
+	}
+}
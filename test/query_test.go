@@ -36,7 +36,7 @@ func TestQueryDiskStat(t *testing.T) {
 	t.Log("cacher logic disk stat", string(bytes))
 }
 
-// get net stat need long time ,please use 'go test -v --run TestQueryMachineStat --timeout=2m'
+// get cpu and net stat need a few seconds
 func TestQueryMachineStat(t *testing.T) {
 	cpuStat, err := cache.GetCPUStats()
 	if err != nil {
@@ -0,0 +1,93 @@
+package test
+
+import (
+	"cess-cacher/base/trans/tcp"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/CESSProject/go-keyring"
+)
+
+// signedRequest signs a download request of the slice for the miner, ts overrides its timestamp if not zero
+func signedRequest(t *testing.T, miner [32]byte, ts int64) *tcp.Message {
+	kr, err := keyring.Generate(12, keyring.NetSubstrate{})
+	if err != nil {
+		t.Fatal("generate keyring error", err)
+	}
+	req, err := tcp.NewDownloadRequest("fid", "sid", miner)
+	if err != nil {
+		t.Fatal("new download request error", err)
+	}
+	if ts != 0 {
+		req.Timestamp = ts
+	}
+	msg, sign, err := req.Sign(kr)
+	if err != nil {
+		t.Fatal("sign download request error", err)
+	}
+	pub := kr.Public()
+	return &tcp.Message{Pubkey: pub[:], SignMsg: msg, Sign: sign}
+}
+
+func TestDownloadRequestRoundTrip(t *testing.T) {
+	miner := [32]byte{1}
+	m := signedRequest(t, miner, 0)
+	req, err := tcp.VerifyDownloadRequest(m, "fid", "sid", miner, tcp.NewReplayGuard())
+	if err != nil {
+		t.Fatal("verify download request error", err)
+	}
+	if req.Fid != "fid" || req.Sid != "sid" || req.Miner != miner {
+		t.Fatalf("decoded request %+v", req)
+	}
+	m.SignMsg[len(m.SignMsg)-1] ^= 0xff
+	if _, err = tcp.VerifyDownloadRequest(m, "fid", "sid", miner, nil); !errors.Is(err, tcp.ErrRequestSignature) {
+		t.Fatal("tampered request is accepted", err)
+	}
+}
+
+func TestDownloadRequestTarget(t *testing.T) {
+	miner := [32]byte{1}
+	cases := []struct {
+		name     string
+		fid, sid string
+		miner    [32]byte
+	}{
+		{"wrong miner", "fid", "sid", [32]byte{2}},
+		{"wrong slice", "fid", "other", miner},
+		{"wrong file", "other", "sid", miner},
+	}
+	for _, c := range cases {
+		m := signedRequest(t, miner, 0)
+		_, err := tcp.VerifyDownloadRequest(m, c.fid, c.sid, c.miner, nil)
+		if !errors.Is(err, tcp.ErrRequestTarget) {
+			t.Fatalf("%s: got error %v, want %v", c.name, err, tcp.ErrRequestTarget)
+		}
+	}
+}
+
+func TestDownloadRequestExpired(t *testing.T) {
+	miner := [32]byte{1}
+	ts := time.Now().Add(-tcp.Request_Max_Skew - time.Minute).Unix()
+	m := signedRequest(t, miner, ts)
+	if _, err := tcp.VerifyDownloadRequest(m, "fid", "sid", miner, nil); !errors.Is(err, tcp.ErrRequestExpired) {
+		t.Fatalf("got error %v, want %v", err, tcp.ErrRequestExpired)
+	}
+	ts = time.Now().Add(tcp.Request_Max_Skew + time.Minute).Unix()
+	m = signedRequest(t, miner, ts)
+	if _, err := tcp.VerifyDownloadRequest(m, "fid", "sid", miner, nil); !errors.Is(err, tcp.ErrRequestExpired) {
+		t.Fatalf("got error %v for future request, want %v", err, tcp.ErrRequestExpired)
+	}
+}
+
+func TestDownloadRequestReplayed(t *testing.T) {
+	miner := [32]byte{1}
+	guard := tcp.NewReplayGuard()
+	m := signedRequest(t, miner, 0)
+	if _, err := tcp.VerifyDownloadRequest(m, "fid", "sid", miner, guard); err != nil {
+		t.Fatal("verify download request error", err)
+	}
+	if _, err := tcp.VerifyDownloadRequest(m, "fid", "sid", miner, guard); !errors.Is(err, tcp.ErrRequestReplayed) {
+		t.Fatalf("got error %v, want %v", err, tcp.ErrRequestReplayed)
+	}
+}
@@ -0,0 +1,90 @@
+package test
+
+import (
+	"cess-cacher/base/cluster"
+	"cess-cacher/base/trans"
+	"fmt"
+	"testing"
+)
+
+const ringKeys = 10000
+
+func ringNodes(n int) []trans.Peer {
+	nodes := make([]trans.Peer, n)
+	for i := range nodes {
+		nodes[i].Pubkey[0] = byte(i + 1)
+		nodes[i].Account = fmt.Sprintf("account-%d", i)
+		nodes[i].URL = fmt.Sprintf("http://node-%d", i)
+	}
+	return nodes
+}
+
+func ringOwners(r *cluster.Ring) []trans.Peer {
+	owners := make([]trans.Peer, ringKeys)
+	for i := range owners {
+		owners[i] = r.Owner(fmt.Sprintf("fid-sid%d", i))
+	}
+	return owners
+}
+
+// TestRingPlacement checks that nodes agree on the owners whatever the order and the account format of config
+func TestRingPlacement(t *testing.T) {
+	nodes := ringNodes(4)
+	want := ringOwners(cluster.NewRing(nodes, cluster.RING_VNODES))
+
+	other := make([]trans.Peer, 0, len(nodes)+1)
+	for i := len(nodes) - 1; i >= 0; i-- {
+		node := nodes[i]
+		node.Account = fmt.Sprintf("other-format-%d", i)
+		other = append(other, node)
+	}
+	//a node configured twice is placed once
+	other = append(other, nodes[0])
+	got := ringOwners(cluster.NewRing(other, cluster.RING_VNODES))
+	for i := range want {
+		if got[i].Pubkey != want[i].Pubkey {
+			t.Fatalf("key %d is owned by %s, want %s", i, got[i].URL, want[i].URL)
+		}
+	}
+	counts := make(map[[32]byte]int)
+	for _, node := range want {
+		counts[node.Pubkey]++
+	}
+	for _, node := range nodes {
+		if counts[node.Pubkey] < ringKeys/len(nodes)/2 {
+			t.Fatalf("node %s owns %d of %d keys", node.URL, counts[node.Pubkey], ringKeys)
+		}
+	}
+}
+
+// TestRingRemap checks that only the keys of the node joining or leaving move
+func TestRingRemap(t *testing.T) {
+	nodes := ringNodes(5)
+	before := ringOwners(cluster.NewRing(nodes[:4], cluster.RING_VNODES))
+	after := ringOwners(cluster.NewRing(nodes, cluster.RING_VNODES))
+	var moved int
+	for i := range before {
+		if before[i].Pubkey == after[i].Pubkey {
+			continue
+		}
+		moved++
+		if after[i].Pubkey != nodes[4].Pubkey {
+			t.Fatalf("key %d moves from %s to %s, not to the node joining", i, before[i].URL, after[i].URL)
+		}
+	}
+	if moved == 0 || moved > ringKeys*2/len(nodes) {
+		t.Fatalf("%d of %d keys move when a node joins", moved, ringKeys)
+	}
+
+	//the keys of other nodes stay when a node leaves
+	left := append(append([]trans.Peer{}, nodes[:1]...), nodes[2:]...)
+	remain := ringOwners(cluster.NewRing(left, cluster.RING_VNODES))
+	for i := range after {
+		if after[i].Pubkey != nodes[1].Pubkey && remain[i].Pubkey != after[i].Pubkey {
+			t.Fatalf("key %d moves from %s to %s when %s leaves", i, after[i].URL, remain[i].URL, nodes[1].URL)
+		}
+		if remain[i].Pubkey == nodes[1].Pubkey {
+			t.Fatalf("key %d is owned by %s which left", i, nodes[1].URL)
+		}
+	}
+}
@@ -0,0 +1,166 @@
+package test
+
+import (
+	"bytes"
+	"cess-cacher/base/trans/tcp"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"io"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/CESSProject/go-keyring"
+)
+
+func newKeyRing(t *testing.T) *keyring.KeyRing {
+	kr, err := keyring.Generate(12, keyring.NetSubstrate{})
+	if err != nil {
+		t.Fatal("generate keyring error", err)
+	}
+	return kr
+}
+
+func testCert(t *testing.T) tls.Certificate {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal("generate key error", err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "miner"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, pub, priv)
+	if err != nil {
+		t.Fatal("create certificate error", err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: priv}
+}
+
+// bindingProof signs the keying material of the session for the role, as the peers of SecureClient do
+func bindingProof(kr *keyring.KeyRing, binding []byte, role byte) ([]byte, error) {
+	msg := append(append([]byte(tcp.Secure_Binding_Label), binding...), role)
+	sign, err := kr.Sign(kr.SigningContext(msg))
+	if err != nil {
+		return nil, err
+	}
+	pub := kr.Public()
+	return append(pub[:], sign[:]...), nil
+}
+
+// secureMiner runs the miner side of the secure handshake, it verifies the proof of the cacher and
+// answers with proof, or with the proof of kr over this session if proof is nil. It returns the proof sent.
+func secureMiner(conn net.Conn, cert tls.Certificate, kr *keyring.KeyRing, proof []byte) ([]byte, error) {
+	tconn := tls.Server(conn, &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS13,
+		ClientAuth:   tls.RequireAnyClientCert,
+	})
+	defer tconn.Close()
+	if err := tconn.Handshake(); err != nil {
+		return nil, err
+	}
+	state := tconn.ConnectionState()
+	binding, err := state.ExportKeyingMaterial(tcp.Secure_Binding_Label, nil, tcp.Secure_Binding_Size)
+	if err != nil {
+		return nil, err
+	}
+	client := make([]byte, tcp.Secure_Proof_Size)
+	if _, err = io.ReadFull(tconn, client); err != nil {
+		return nil, err
+	}
+	var (
+		pub  [32]byte
+		sign [64]byte
+	)
+	copy(pub[:], client[:32])
+	copy(sign[:], client[32:])
+	ckr, err := keyring.FromPublic(pub, keyring.NetSubstrate{})
+	if err != nil {
+		return nil, err
+	}
+	msg := append(append([]byte(tcp.Secure_Binding_Label), binding...), 'c')
+	if !ckr.Verify(ckr.SigningContext(msg), sign) {
+		return nil, errors.New("invalid cacher proof")
+	}
+	if proof == nil {
+		if proof, err = bindingProof(kr, binding, 's'); err != nil {
+			return nil, err
+		}
+	}
+	if _, err = tconn.Write(proof); err != nil {
+		return nil, err
+	}
+	//the connection is kept until the cacher has read the proof
+	tconn.Read(make([]byte, 1))
+	return proof, nil
+}
+
+type minerResult struct {
+	proof []byte
+	err   error
+}
+
+// secureSession runs SecureClient of cacher expecting the account miner against secureMiner
+func secureSession(t *testing.T, cacher, mkr *keyring.KeyRing, miner [32]byte, proof []byte) (minerResult, error) {
+	conn, peer := newConnPair(t)
+	cert := testCert(t)
+	done := make(chan minerResult, 1)
+	go func() {
+		proof, err := secureMiner(peer, cert, mkr, proof)
+		done <- minerResult{proof, err}
+	}()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+	sconn, err := tcp.SecureClient(ctx, conn, cacher, miner)
+	if err == nil {
+		sconn.Close()
+	} else {
+		conn.Close()
+	}
+	return <-done, err
+}
+
+func TestSecureHandshake(t *testing.T) {
+	cacher, miner := newKeyRing(t), newKeyRing(t)
+	res, err := secureSession(t, cacher, miner, miner.Public(), nil)
+	if err != nil {
+		t.Fatal("secure client error", err)
+	}
+	if res.err != nil {
+		t.Fatal("miner rejects the cacher", res.err)
+	}
+}
+
+func TestSecureWrongAccount(t *testing.T) {
+	cacher, miner, other := newKeyRing(t), newKeyRing(t), newKeyRing(t)
+	if _, err := secureSession(t, cacher, other, miner.Public(), nil); !errors.Is(err, tcp.ErrPeerIdentity) {
+		t.Fatalf("got error %v, want %v", err, tcp.ErrPeerIdentity)
+	}
+}
+
+// TestSecureReplayedProof checks that the proof of a miner is bound to its tls session,
+// so an impostor replaying it on another session is rejected
+func TestSecureReplayedProof(t *testing.T) {
+	cacher, miner, impostor := newKeyRing(t), newKeyRing(t), newKeyRing(t)
+	res, err := secureSession(t, cacher, miner, miner.Public(), nil)
+	if err != nil || res.err != nil {
+		t.Fatal("secure session error", err, res.err)
+	}
+	pub := miner.Public()
+	if !bytes.Equal(res.proof[:32], pub[:]) {
+		t.Fatal("miner proof does not carry its account")
+	}
+	_, err = secureSession(t, cacher, impostor, miner.Public(), res.proof)
+	if !errors.Is(err, tcp.ErrPeerSignature) {
+		t.Fatalf("got error %v, want %v", err, tcp.ErrPeerSignature)
+	}
+}
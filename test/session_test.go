@@ -0,0 +1,233 @@
+package test
+
+import (
+	"bytes"
+	"cess-cacher/base/trans/tcp"
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/CESSProject/go-keyring"
+)
+
+// fakeMiner serves files named after the request, a miner without session support serves one file
+// per connection and does not carry file names in its messages.
+type fakeMiner struct {
+	session bool
+	// verify checks the requests, all are accepted if it is nil
+	verify func(m *tcp.Message) error
+	// the connection is closed without acknowledging the request of the number, counted from 1
+	drop     int32
+	requests atomic.Int32
+	conns    atomic.Int32
+}
+
+func (f *fakeMiner) listen(t *testing.T) string {
+	session := f.session
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("listen error", err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			f.conns.Add(1)
+			srv := tcp.NewTcp(c)
+			srv.HandlerLoop()
+			go func() {
+				served := 0
+				for {
+					m, ok := srv.GetMsg()
+					if !ok {
+						return
+					}
+					if m == nil {
+						continue
+					}
+					switch m.MsgType {
+					case tcp.MsgRecvHead:
+						if !session && served > 0 {
+							srv.Close()
+							return
+						}
+						if f.verify != nil {
+							if err := f.verify(m); err != nil {
+								srv.SendMsg(tcp.NewNotifyMsg(m.FileName, tcp.Status_Err))
+								srv.SendMsg(tcp.NewCloseMsg(m.FileName, tcp.Status_Err))
+								return
+							}
+						}
+						if f.requests.Add(1) == f.drop {
+							srv.Close()
+							return
+						}
+						n := tcp.NewNotifyMsg("", tcp.Status_Ok)
+						n.Version = tcp.Protocol_Version_Binary
+						if session {
+							n.FileName = m.FileName
+							n.Version = tcp.Protocol_Version_Session
+						}
+						srv.SendMsg(n)
+					case tcp.MsgRecvFile:
+						served++
+						name := m.FileName
+						go func() {
+							data := bytes.Repeat([]byte(name), 5000)
+							tag := name
+							if !session {
+								tag = ""
+							}
+							for i := 0; i < len(data); i += 1000 {
+								chunk := append([]byte{}, data[i:i+1000]...)
+								fm := tcp.NewFileMsg(tag, 1000, chunk)
+								fm.Checksum = tcp.ChunkChecksum(chunk)
+								srv.SendMsg(fm)
+								time.Sleep(time.Millisecond)
+							}
+							srv.SendMsg(tcp.NewEndMsg(tag, "", uint64(len(data)), uint64(len(data)), true))
+							n := tcp.NewNotifyMsg(tag, tcp.Status_Ok)
+							if session {
+								n.Version = tcp.Protocol_Version_Session
+							}
+							srv.SendMsg(n)
+						}()
+					case tcp.MsgClose:
+						srv.Close()
+						return
+					}
+				}
+			}()
+		}
+	}()
+	return l.Addr().String()
+}
+
+// unsigned returns no request, the fake miners verify none by default
+func unsigned() ([]byte, []byte, error) {
+	return nil, nil, nil
+}
+
+// fetchConcurrently fetches files from the miner over a pool, the first one alone so that
+// the session is confirmed before the others, and returns the number of connections used
+func fetchConcurrently(t *testing.T, session bool) int32 {
+	miner := &fakeMiner{session: session}
+	addr := miner.listen(t)
+	pool := tcp.NewPool()
+	defer pool.Close()
+	dial := func(ctx context.Context) (net.Conn, error) { return net.Dial("tcp", addr) }
+	dir := t.TempDir()
+	if err := pool.Fetch(context.Background(), "m", dial, dir, "sid00", 0, nil, unsigned); err != nil {
+		t.Fatal("fetch error", err)
+	}
+	var wg sync.WaitGroup
+	for i := 1; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			sid := fmt.Sprintf("sid%02d", i)
+			if err := pool.Fetch(context.Background(), "m", dial, dir, sid, 0, nil, unsigned); err != nil {
+				t.Error("fetch error", sid, err)
+				return
+			}
+			data, _ := os.ReadFile(filepath.Join(dir, sid))
+			if !bytes.Equal(data, bytes.Repeat([]byte(sid), 5000)) {
+				t.Errorf("file %s received %d bytes of other content", sid, len(data))
+			}
+		}(i)
+	}
+	wg.Wait()
+	return miner.conns.Load()
+}
+
+func TestTcpSessionMultiplex(t *testing.T) {
+	if n := fetchConcurrently(t, true); n != 1 {
+		t.Fatalf("session miner is dialed %d times, want once", n)
+	}
+}
+
+// TestTcpSessionLegacy checks that the connections to miners without session support are not reused
+func TestTcpSessionLegacy(t *testing.T) {
+	if n := fetchConcurrently(t, false); n != 8 {
+		t.Fatalf("legacy miner is dialed %d times, want once per file", n)
+	}
+}
+
+// TestTcpSessionCancel checks that a transfer abandoned by its receiver neither fails the others nor the pool
+func TestTcpSessionCancel(t *testing.T) {
+	addr := (&fakeMiner{session: true}).listen(t)
+	pool := tcp.NewPool()
+	defer pool.Close()
+	dial := func(ctx context.Context) (net.Conn, error) { return net.Dial("tcp", addr) }
+	dir := t.TempDir()
+	if err := pool.Fetch(context.Background(), "m", dial, dir, "sid00", 0, nil, unsigned); err != nil {
+		t.Fatal("fetch error", err)
+	}
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		if err := pool.Fetch(context.Background(), "m", dial, dir, "sid01", 0, nil, unsigned); err != nil {
+			t.Error("fetch error", err)
+		}
+	}()
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Millisecond)
+	defer cancel()
+	if err := pool.Fetch(ctx, "m", dial, dir, "sid02", 0, nil, unsigned); err == nil {
+		t.Fatal("cancelled fetch succeeds")
+	}
+	wg.Wait()
+	if err := pool.Fetch(context.Background(), "m", dial, dir, "sid03", 0, nil, unsigned); err != nil {
+		t.Fatal("fetch after cancel error", err)
+	}
+}
+
+// TestTcpSessionRetrySigned checks that the request retried after a session is closed by the miner
+// is signed again, so that a miner guarding against replays accepts it
+func TestTcpSessionRetrySigned(t *testing.T) {
+	kr, err := keyring.Generate(12, keyring.NetSubstrate{})
+	if err != nil {
+		t.Fatal("generate keyring error", err)
+	}
+	account := [32]byte{1}
+	guard := tcp.NewReplayGuard()
+	miner := &fakeMiner{
+		session: true,
+		verify: func(m *tcp.Message) error {
+			_, err := tcp.VerifyDownloadRequest(m, "fid", m.FileName, account, guard)
+			return err
+		},
+		//the request over the pooled session is seen by the miner but not acknowledged
+		drop: 2,
+	}
+	addr := miner.listen(t)
+	pool := tcp.NewPool()
+	defer pool.Close()
+	dial := func(ctx context.Context) (net.Conn, error) { return net.Dial("tcp", addr) }
+	dir := t.TempDir()
+	for _, sid := range []string{"sid00", "sid01"} {
+		sign := func() ([]byte, []byte, error) {
+			req, err := tcp.NewDownloadRequest("fid", sid, account)
+			if err != nil {
+				return nil, nil, err
+			}
+			return req.Sign(kr)
+		}
+		pub := kr.Public()
+		if err := pool.Fetch(context.Background(), "m", dial, dir, sid, 0, pub[:], sign); err != nil {
+			t.Fatal("fetch error", sid, err)
+		}
+	}
+	if n := miner.conns.Load(); n != 2 {
+		t.Fatalf("miner is dialed %d times, want once more for the retry", n)
+	}
+}
@@ -0,0 +1,143 @@
+package test
+
+import (
+	"cess-cacher/base/trans"
+	"cess-cacher/config"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// sourceDir returns a directory holding the slice sid with content
+func sourceDir(t *testing.T, sid, content string) string {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, sid), []byte(content), 0666); err != nil {
+		t.Fatal("write source slice error", err)
+	}
+	return dir
+}
+
+func initSources(t *testing.T, sources ...string) {
+	if err := trans.InitSources(config.Config{Sources: sources}); err != nil {
+		t.Fatal("init sources error", err)
+	}
+}
+
+// checkSlice checks that dir holds only the slice sid with content
+func checkSlice(t *testing.T, dir, sid, content string) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal("read dir error", err)
+	}
+	if len(entries) != 1 || entries[0].Name() != sid {
+		t.Fatalf("dir holds %v, want only %s", entries, sid)
+	}
+	data, err := os.ReadFile(filepath.Join(dir, sid))
+	if err != nil {
+		t.Fatal("read slice error", err)
+	}
+	if string(data) != content {
+		t.Fatalf("slice content %q, want %q", data, content)
+	}
+}
+
+func TestFillSourceOrder(t *testing.T) {
+	first, second := sourceDir(t, "sid", "first"), sourceDir(t, "sid", "other")
+	initSources(t, "dir:"+first, "dir:"+second)
+	dir := t.TempDir()
+	if err := trans.Fill(context.Background(), "fid", dir, "sid", 5); err != nil {
+		t.Fatal("fill error", err)
+	}
+	checkSlice(t, dir, "sid", "first")
+}
+
+func TestFillSourceFallback(t *testing.T) {
+	missing, second := t.TempDir(), sourceDir(t, "sid", "second")
+	initSources(t, "dir:"+missing, "dir:"+second)
+	dir := t.TempDir()
+	if err := trans.Fill(context.Background(), "fid", dir, "sid", 6); err != nil {
+		t.Fatal("fill error", err)
+	}
+	checkSlice(t, dir, "sid", "second")
+}
+
+func TestFillSourceAllFailed(t *testing.T) {
+	first, second := t.TempDir(), t.TempDir()
+	initSources(t, "dir:"+first, "dir:"+second)
+	dir := t.TempDir()
+	err := trans.Fill(context.Background(), "fid", dir, "sid", 6)
+	if err == nil {
+		t.Fatal("fill from empty sources succeeds")
+	}
+	//the error tells why every source failed
+	for _, src := range []string{"dir:" + first, "dir:" + second} {
+		if !strings.Contains(err.Error(), src+": ") {
+			t.Fatalf("error %q does not mention source %s", err, src)
+		}
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 0 {
+		t.Fatalf("failed fill leaves %v", entries)
+	}
+}
+
+// TestFillSourcePartial checks that a source failing in the middle of a slice leaves nothing for the next one
+func TestFillSourcePartial(t *testing.T) {
+	gateway := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/fid/sid" {
+			http.NotFound(w, r)
+			return
+		}
+		//the body is cut off before the announced length
+		w.Header().Set("Content-Length", "1024")
+		w.Write([]byte("partial"))
+	}))
+	defer gateway.Close()
+	second := sourceDir(t, "sid", "second")
+	initSources(t, "gateway:"+gateway.URL, "dir:"+second)
+
+	dir := t.TempDir()
+	if err := trans.NewGatewaySource(gateway.URL).Fetch(context.Background(), "fid", "sid", dir); err == nil {
+		t.Fatal("partial slice is accepted")
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 0 {
+		t.Fatalf("partial fetch leaves %v", entries)
+	}
+	if err := trans.Fill(context.Background(), "fid", dir, "sid", 6); err != nil {
+		t.Fatal("fill error", err)
+	}
+	checkSlice(t, dir, "sid", "second")
+}
+
+// TestFillSourceSize checks that slices of other sizes than the one on chain are dropped,
+// whether the source announces their length or not
+func TestFillSourceSize(t *testing.T) {
+	gateway := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		//the body is padded and sent without Content-Length
+		w.Write([]byte("second"))
+		w.(http.Flusher).Flush()
+		w.Write([]byte("padding"))
+	}))
+	defer gateway.Close()
+	padded, truncated := sourceDir(t, "sid", "second padded"), sourceDir(t, "sid", "sec")
+	second := sourceDir(t, "sid", "second")
+	initSources(t, "gateway:"+gateway.URL, "dir:"+padded, "dir:"+truncated, "dir:"+second)
+
+	dir := t.TempDir()
+	if err := trans.Fill(context.Background(), "fid", dir, "sid", 6); err != nil {
+		t.Fatal("fill error", err)
+	}
+	checkSlice(t, dir, "sid", "second")
+
+	initSources(t, "gateway:"+gateway.URL, "dir:"+padded, "dir:"+truncated)
+	dir = t.TempDir()
+	if err := trans.Fill(context.Background(), "fid", dir, "sid", 6); err == nil {
+		t.Fatal("slices of wrong size are accepted")
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 0 {
+		t.Fatalf("slices of wrong size leave %v", entries)
+	}
+}
@@ -0,0 +1,340 @@
+package test
+
+import (
+	"bytes"
+	"cess-cacher/base/trans/tcp"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// newConnPair connects two tcp sockets on loopback
+func newConnPair(b testing.TB) (net.Conn, net.Conn) {
+	ln, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		b.Fatal("listen error", err)
+	}
+	defer ln.Close()
+	accepted := make(chan *net.TCPConn, 1)
+	go func() {
+		conn, err := ln.AcceptTCP()
+		if err != nil {
+			close(accepted)
+			return
+		}
+		accepted <- conn
+	}()
+	conn, err := net.DialTCP("tcp", nil, ln.Addr().(*net.TCPAddr))
+	if err != nil {
+		b.Fatal("dial error", err)
+	}
+	peer, ok := <-accepted
+	if !ok {
+		b.Fatal("accept error")
+	}
+	return conn, peer
+}
+
+// newTcpPair connects two tcp connections on loopback and starts their message loops
+func newTcpPair(b testing.TB) (*tcp.TcpCon, *tcp.TcpCon) {
+	conn, peer := newConnPair(b)
+	client, server := tcp.NewTcp(conn), tcp.NewTcp(peer)
+	client.HandlerLoop()
+	server.HandlerLoop()
+	return client, server
+}
+
+// run 'go test -bench TcpCon -run XXX' to measure the throughput of one connection
+func BenchmarkTcpConThroughput(b *testing.B) {
+	benchmarkThroughput(b, false, tcp.TCP_SendBuffer)
+}
+
+func BenchmarkTcpConThroughputBinary(b *testing.B) {
+	benchmarkThroughput(b, true, tcp.TCP_FrameBuffer)
+}
+
+func benchmarkThroughput(b *testing.B, binary bool, chunk int) {
+	client, server := newTcpPair(b)
+	defer server.Close()
+	if binary {
+		client.EnableBinary()
+	}
+	buf := make([]byte, chunk)
+	done := make(chan int)
+	go func() {
+		var count int
+		for count < b.N {
+			m, ok := server.GetMsg()
+			if !ok {
+				break
+			}
+			if m != nil && m.FileSize == uint64(chunk) {
+				count++
+			}
+		}
+		done <- count
+	}()
+	b.SetBytes(int64(chunk))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := client.SendMsg(tcp.NewFileMsg("bench", len(buf), buf)); err != nil {
+			b.Fatal("send message error", err)
+		}
+	}
+	if count := <-done; count != b.N {
+		b.Fatalf("received %d messages, want %d", count, b.N)
+	}
+	b.StopTimer()
+	client.Close()
+	<-client.Done()
+}
+
+// BenchmarkTcpConRoundTrip measures the latency of a message and its notify
+func BenchmarkTcpConRoundTrip(b *testing.B) {
+	client, server := newTcpPair(b)
+	defer server.Close()
+	go func() {
+		for {
+			m, ok := server.GetMsg()
+			if !ok {
+				return
+			}
+			if m != nil {
+				server.SendMsg(tcp.NewNotifyMsg(m.FileName, tcp.Status_Ok))
+			}
+		}
+	}()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := client.SendMsg(tcp.NewRecvFileMsg("bench")); err != nil {
+			b.Fatal("send message error", err)
+		}
+		for {
+			m, ok := client.GetMsg()
+			if !ok {
+				b.Fatal("connection closed")
+			}
+			if m != nil {
+				break
+			}
+		}
+	}
+	b.StopTimer()
+	client.Close()
+	<-client.Done()
+}
+
+// recvMsg returns the next message of conn, ok is false if the connection is closed
+func recvMsg(t *testing.T, conn *tcp.TcpCon) (*tcp.Message, bool) {
+	for i := 0; i < 3; i++ {
+		m, ok := conn.GetMsg()
+		if !ok {
+			return nil, false
+		}
+		if m != nil {
+			return m, true
+		}
+	}
+	t.Fatal("receive message timeout")
+	return nil, false
+}
+
+// testMsg returns a message with all fields of binary frames set
+func testMsg(payload []byte) *tcp.Message {
+	return &tcp.Message{
+		MsgType:  tcp.MsgFile,
+		FileType: tcp.FileType_file,
+		LastMark: true,
+		Version:  tcp.Protocol_Version,
+		FileSize: uint64(len(payload)),
+		FileName: "name",
+		FileHash: "hash",
+		Pubkey:   []byte("pubkey"),
+		SignMsg:  []byte("signmsg"),
+		Sign:     []byte("sign"),
+		Checksum: tcp.ChunkChecksum(payload),
+		Digest:   []byte("digest"),
+		Bytes:    append([]byte{}, payload...),
+	}
+}
+
+func TestTcpFrameRoundTrip(t *testing.T) {
+	client, server := newTcpPair(t)
+	defer client.Close()
+	defer server.Close()
+	client.EnableBinary()
+	payload := bytes.Repeat([]byte("c200"), tcp.TCP_FrameBuffer/4)
+	want := testMsg(payload)
+	if err := client.SendMsg(testMsg(payload)); err != nil {
+		t.Fatal("send message error", err)
+	}
+	got, ok := recvMsg(t, server)
+	if !ok {
+		t.Fatal("connection closed")
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("received %+v, want %+v", got, want)
+	}
+}
+
+// TestTcpFrameInterop checks that a peer sending binary frames and a peer sending JSON understand each other
+func TestTcpFrameInterop(t *testing.T) {
+	client, server := newTcpPair(t)
+	defer client.Close()
+	defer server.Close()
+	client.EnableBinary()
+	payload := []byte("interop")
+	for _, c := range []struct {
+		name     string
+		from, to *tcp.TcpCon
+	}{
+		{"binary to JSON", client, server},
+		{"JSON to binary", server, client},
+	} {
+		if err := c.from.SendMsg(testMsg(payload)); err != nil {
+			t.Fatalf("%s: send message error %v", c.name, err)
+		}
+		got, ok := recvMsg(t, c.to)
+		if !ok {
+			t.Fatalf("%s: connection closed", c.name)
+		}
+		if !reflect.DeepEqual(got, testMsg(payload)) {
+			t.Fatalf("%s: received %+v", c.name, got)
+		}
+	}
+}
+
+func TestTcpFramePayloadLimit(t *testing.T) {
+	//a frame announcing a payload over the limit closes the connection
+	conn, peer := newConnPair(t)
+	defer conn.Close()
+	server := tcp.NewTcp(peer)
+	server.HandlerLoop()
+	defer server.Close()
+	header := make([]byte, tcp.TCP_FrameHeader)
+	copy(header, tcp.HEAD_FRAME)
+	header[4] = byte(tcp.MsgFile)
+	binary.BigEndian.PutUint32(header[30:34], tcp.TCP_MaxFramePayload+1)
+	if _, err := conn.Write(header); err != nil {
+		t.Fatal("write frame error", err)
+	}
+	if _, ok := recvMsg(t, server); ok {
+		t.Fatal("oversized frame is accepted")
+	}
+
+	//an oversized message is not sent
+	client, server := newTcpPair(t)
+	defer server.Close()
+	client.EnableBinary()
+	client.SendMsg(&tcp.Message{MsgType: tcp.MsgFile, Bytes: make([]byte, tcp.TCP_MaxFramePayload+1)})
+	if _, ok := recvMsg(t, server); ok {
+		t.Fatal("oversized frame is sent")
+	}
+}
+
+// serveFile acts as the miner of a download, it acknowledges the request and sends the messages returned by file
+func serveFile(server *tcp.TcpCon, file func() []*tcp.Message) {
+	for {
+		m, ok := server.GetMsg()
+		if !ok {
+			return
+		}
+		if m == nil {
+			continue
+		}
+		switch m.MsgType {
+		case tcp.MsgRecvHead:
+			server.SendMsg(tcp.NewNotifyMsg("", tcp.Status_Ok))
+		case tcp.MsgRecvFile:
+			for _, fm := range file() {
+				server.SendMsg(fm)
+			}
+		}
+	}
+}
+
+// recvTestFile downloads the file served by file and checks that the transfer fails with want,
+// leaving no partial file behind.
+func recvTestFile(t *testing.T, file func() []*tcp.Message, want error) {
+	client, server := newTcpPair(t)
+	defer server.Close()
+	go serveFile(server, file)
+	dir := t.TempDir()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+	err := tcp.NewClient(client, dir, nil).RecvFile(ctx, "fid", 8, nil, nil, nil)
+	if !errors.Is(err, want) {
+		t.Fatalf("got error %v, want %v", err, want)
+	}
+	if _, err = os.Stat(filepath.Join(dir, "fid")); !os.IsNotExist(err) {
+		t.Fatal("partial file is left", err)
+	}
+}
+
+func TestTcpRecvChecksumMismatch(t *testing.T) {
+	recvTestFile(t, func() []*tcp.Message {
+		chunk := []byte("chunk-01")
+		m := tcp.NewFileMsg("fid", len(chunk), chunk)
+		m.Checksum = tcp.ChunkChecksum([]byte("chunk-02"))
+		return []*tcp.Message{m}
+	}, tcp.ErrChecksumMismatch)
+}
+
+func TestTcpRecvDigestMismatch(t *testing.T) {
+	recvTestFile(t, func() []*tcp.Message {
+		chunk := []byte("chunk-01")
+		m := tcp.NewFileMsg("fid", len(chunk), chunk)
+		m.Checksum = tcp.ChunkChecksum(chunk)
+		end := tcp.NewEndMsg("fid", "fid", uint64(len(chunk)), uint64(len(chunk)), true)
+		sum := sha256.Sum256([]byte("chunk-02"))
+		end.Digest = sum[:]
+		return []*tcp.Message{m, end}
+	}, tcp.ErrDigestMismatch)
+}
+
+func TestTcpRecvChunkSize(t *testing.T) {
+	recvTestFile(t, func() []*tcp.Message {
+		chunk := []byte("chunk-01")
+		m := tcp.NewFileMsg("fid", len(chunk), chunk)
+		m.FileSize = 1024
+		return []*tcp.Message{m}
+	}, tcp.ErrChunkSize)
+}
+
+func TestTcpRecvFileSize(t *testing.T) {
+	recvTestFile(t, func() []*tcp.Message {
+		chunk := []byte("chunk-01")
+		m := tcp.NewFileMsg("fid", len(chunk), chunk)
+		m.Checksum = tcp.ChunkChecksum(chunk)
+		end := tcp.NewEndMsg("fid", "fid", uint64(len(chunk))+1, uint64(len(chunk))+1, true)
+		return []*tcp.Message{m, end}
+	}, tcp.ErrFileSize)
+}
+
+// TestTcpFileMsgSize checks that chunks of any size up to the payload limit are sent
+func TestTcpFileMsgSize(t *testing.T) {
+	client, server := newTcpPair(t)
+	defer client.Close()
+	defer server.Close()
+	client.EnableBinary()
+	for _, size := range []int{1, tcp.TCP_SendBuffer + 1, tcp.TCP_FrameBuffer, tcp.TCP_FrameBuffer + 1} {
+		chunk := bytes.Repeat([]byte{byte(size)}, size)
+		if err := client.SendMsg(tcp.NewFileMsg("fid", size, chunk)); err != nil {
+			t.Fatalf("send chunk of %d bytes error %v", size, err)
+		}
+		m, ok := recvMsg(t, server)
+		if !ok {
+			t.Fatalf("connection closed after chunk of %d bytes", size)
+		}
+		if int(m.FileSize) != size || !bytes.Equal(m.Bytes[:m.FileSize], chunk) {
+			t.Fatalf("chunk of %d bytes received as %d bytes", size, m.FileSize)
+		}
+	}
+}
@@ -0,0 +1,58 @@
+package utils
+
+import (
+	"sync"
+	"time"
+)
+
+// RateMeter measures throughput in a sliding window of one-second buckets
+type RateMeter struct {
+	lock    sync.Mutex
+	buckets []uint64
+	stamps  []int64
+}
+
+// NewRateMeter creates a meter whose rates can be measured in windows up to the given size
+func NewRateMeter(window time.Duration) *RateMeter {
+	n := int(window / time.Second)
+	if n < 1 {
+		n = 1
+	}
+	return &RateMeter{
+		buckets: make([]uint64, n),
+		stamps:  make([]int64, n),
+	}
+}
+
+func (m *RateMeter) Add(n uint64) {
+	now := time.Now().Unix()
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	i := int(now % int64(len(m.buckets)))
+	if m.stamps[i] != now {
+		m.stamps[i] = now
+		m.buckets[i] = 0
+	}
+	m.buckets[i] += n
+}
+
+// Rate returns the average bytes per second in the latest window
+func (m *RateMeter) Rate(window time.Duration) uint64 {
+	secs := int64(window / time.Second)
+	if secs < 1 {
+		secs = 1
+	}
+	if secs > int64(len(m.buckets)) {
+		secs = int64(len(m.buckets))
+	}
+	now := time.Now().Unix()
+	var sum uint64
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	for i, stamp := range m.stamps {
+		if now-stamp < secs {
+			sum += m.buckets[i]
+		}
+	}
+	return sum / uint64(secs)
+}